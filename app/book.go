@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A conversation can be exported as a book: an EPUB, or an HTML page laid out for printing.
+Both have a title page, a table of contents by month, and the letters in the order they were
+written. The page for printing is XHTML, so it is also the text of the EPUB.
+*/
+
+// formats a book can be exported in, and their content types
+var bookFormats = map[string]string{
+	"epub": "application/epub+zip",
+	"html": "text/html; charset=utf-8",
+}
+
+/*
+	loadBook
+
+Lays out the delivered mail in a conversation as a book, with the letters grouped by the
+month they were written. `recipientName` is the name of the user the letters were written to.
+*/
+func loadBook(userId int, recipientName string, sender Sender, date int64) (bookData, error) {
+	senderName := sender.SenderName
+	if senderName == "" {
+		senderName = sender.SenderAddr
+	}
+	book := bookData{Id: fmt.Sprintf("slowmail:%d:%s", userId, sender.SenderAddr), Title: "Letters from " + senderName + " to " + recipientName,
+		Sender: senderName, Recipient: recipientName}
+
+	mails, err := loadWholeConv(userId, sender.SenderAddr, date)
+	if err != nil {
+		return book, err
+	}
+	for _, m := range mails {
+		written := time.Unix(m.OrigDate, 0)
+		monthId := "month-" + written.Format("2006-01")
+		if len(book.Months) == 0 || book.Months[len(book.Months)-1].Id != monthId {
+			book.Months = append(book.Months, bookMonth{Id: monthId, Name: written.Format("January 2006")})
+		}
+
+		letter := bookLetter{Id: "letter-" + strconv.Itoa(m.MailId), Date: written.Format("Monday, January 2, 2006"),
+			Subject: m.Subject, Content: m.Content, PlainText: m.PlainText}
+		if !letter.PlainText {
+			// the book is XHTML, where every tag is closed
+			letter.HTML = template.HTML(strings.ReplaceAll(string(renderMarkdown(m.Content)), "<br>", "<br />"))
+		}
+
+		month := &book.Months[len(book.Months)-1]
+		month.Letters = append(month.Letters, letter)
+	}
+	return book, nil
+}
+
+/* writeBook: writes a book in one of the bookFormats */
+func writeBook(writer io.Writer, format string, book bookData) error {
+	if format == "epub" {
+		return writeEpub(writer, book)
+	}
+	return temps.ExecuteTemplate(writer, "book.go.tmpl", book)
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+    <rootfiles>
+        <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+    </rootfiles>
+</container>
+`
+
+const epubPackage = `<?xml version="1.0" encoding="UTF-8"?>
+<package version="3.0" xmlns="http://www.idpf.org/2007/opf" unique-identifier="book-id">
+    <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+        <dc:identifier id="book-id">%s</dc:identifier>
+        <dc:title>%s</dc:title>
+        <dc:creator>%s</dc:creator>
+        <dc:language>en</dc:language>
+        <meta property="dcterms:modified">%s</meta>
+    </metadata>
+    <manifest>
+        <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+        <item id="book" href="book.xhtml" media-type="application/xhtml+xml"/>
+    </manifest>
+    <spine>
+        <itemref idref="book"/>
+    </spine>
+</package>
+`
+
+/*
+	writeEpub
+
+Writes a book as an EPUB 3 file: the page for printing as its text, and a navigation
+document with the months and letters.
+*/
+func writeEpub(writer io.Writer, book bookData) error {
+	var text, nav bytes.Buffer
+	err := temps.ExecuteTemplate(&text, "book.go.tmpl", book)
+	if err != nil {
+		return err
+	}
+	err = temps.ExecuteTemplate(&nav, "booknav.go.tmpl", book)
+	if err != nil {
+		return err
+	}
+	opf := fmt.Sprintf(epubPackage, template.HTMLEscapeString(book.Id), template.HTMLEscapeString(book.Title),
+		template.HTMLEscapeString(book.Sender), time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+
+	archive := zip.NewWriter(writer)
+	// the mimetype comes first and uncompressed, so that readers can recognize the file
+	mimetype, err := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(mimetype, bookFormats["epub"])
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"META-INF/container.xml", []byte(epubContainer)},
+		{"OEBPS/content.opf", []byte(opf)},
+		{"OEBPS/nav.xhtml", nav.Bytes()},
+		{"OEBPS/book.xhtml", text.Bytes()},
+	}
+	for _, f := range files {
+		file, err := archive.Create(f.name)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(f.content)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"html/template"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -51,6 +56,16 @@ func renderPage(writer http.ResponseWriter, req *http.Request, pdata any) {
 	// extract last part of path
 	tempName := url[strings.LastIndex(url, "/")+1:]
 
+	renderTemplate(writer, tempName, pdata)
+}
+
+/*
+	renderTemplate
+
+Renders the named template, for pages whose path doesn't end with the template name.
+`pdata` is page data, and the proper type depends on the template being rendered.
+*/
+func renderTemplate(writer http.ResponseWriter, tempName string, pdata any) {
 	var b bytes.Buffer
 	err := temps.ExecuteTemplate(&b, tempName+".go.tmpl", pdata)
 	if err != nil {
@@ -67,7 +82,34 @@ func getSignup(writer http.ResponseWriter, req *http.Request) {
 }
 
 func getLogin(writer http.ResponseWriter, req *http.Request) {
-	renderPage(writer, req, loginData{false, false, ""})
+	renderPage(writer, req, loginData{CanReset: transport != nil, Reset: req.URL.Query().Has("reset")})
+}
+
+/* getResetRequest: shows the form to ask for a password reset link */
+func getResetRequest(writer http.ResponseWriter, req *http.Request) {
+	if transport == nil {
+		http.NotFound(writer, req)
+		return
+	}
+	renderTemplate(writer, "reset", resetData{})
+}
+
+/* getResetPassword: shows the form to choose a new password, for the token in a reset link */
+func getResetPassword(writer http.ResponseWriter, req *http.Request) {
+	if transport == nil {
+		http.NotFound(writer, req)
+		return
+	}
+	// the token is in the path, so it shouldn't be sent on to any other site
+	writer.Header().Set("Referrer-Policy", "no-referrer")
+
+	token := req.PathValue("token")
+	_, err := loadPasswordReset(hashResetToken(token), time.Now().Unix())
+	if err != nil && err != ErrNotFound {
+		internalError(writer, err)
+		return
+	}
+	renderTemplate(writer, "resetpassword", resetPasswordData{Token: token, Invalid: err == ErrNotFound})
 }
 
 /*
@@ -106,6 +148,78 @@ func mailsToPage[T any](mails []T, page int, next int) []T {
 	return pageMails
 }
 
+/*
+	parseCursor
+
+Parses the query parameters of a page loaded with loadPage, and returns where the page
+starts and its page number. Links to the next page pass `after`, the key of the last mail
+on the page before it, and links to the previous page pass `before`. Without either, the
+page number is used to find the page, as in parsePages.
+*/
+func parseCursor(req *http.Request) (PageCursor, int) {
+	page, err := strconv.Atoi(req.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	if key, ok := parseKey(req.FormValue("after")); ok {
+		return PageCursor{Key: key}, page
+	}
+	if key, ok := parseKey(req.FormValue("before")); ok {
+		return PageCursor{Key: key, Back: true}, page
+	}
+	return PageCursor{Offset: (page - 1) * mailPerPage}, page
+}
+
+/* parseKey: parses the key of a row in a page link, written by formatKey */
+func parseKey(param string) ([]any, bool) {
+	if param == "" {
+		return nil, false
+	}
+	var key []any
+	for _, part := range strings.Split(param, ".") {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		key = append(key, n)
+	}
+	return key, true
+}
+
+/* formatKey: writes the key of a row for a page link, as its columns separated by dots */
+func formatKey(key []any) string {
+	var parts []string
+	for _, k := range key {
+		parts = append(parts, fmt.Sprint(k))
+	}
+	return strings.Join(parts, ".")
+}
+
+/*
+	makePageData
+
+Makes the page links for a page loaded with loadPage. The page number only labels the page,
+and the first page is always page 1.
+*/
+func makePageData[V any](loaded Page[V], page int) pageData {
+	if loaded.PrevKey == nil {
+		page = 1
+	} else if page == 1 {
+		// mail has arrived since the previous page was loaded
+		page = 2
+	}
+
+	data := pageData{PrevKey: formatKey(loaded.PrevKey), NextKey: formatKey(loaded.NextKey)}
+	if loaded.PrevKey != nil {
+		data.PagePrev = page - 1
+	}
+	if loaded.NextKey != nil {
+		data.PageNext = page + 1
+	}
+	return data
+}
+
 func currDate() time.Time {
 	currTime := time.Now()
 	date := time.Date(currTime.Year(), currTime.Month(), currTime.Day(), 0, 0, 0, 0, time.Local)
@@ -120,15 +234,85 @@ func currDate() time.Time {
 	return date
 }
 
+/*
+	userLocation
+
+The time zone to show a user times in, from their preference. Delivery days are the
+server's, so dates of letters aren't shown in it.
+*/
+func userLocation(timeZone string) *time.Location {
+	if timeZone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+/*
+	loadNav
+
+Loads the data shown in the navigation bar for the session's user.
+*/
+func loadNav(session SessionUser) (navData, error) {
+	unread, err := countUnread(session.UserId, currDate().Unix())
+	if err != nil {
+		return navData{}, err
+	}
+	requests, err := countRequests(session.UserId, currDate().Unix())
+	if err != nil {
+		return navData{}, err
+	}
+	labels, err := loadLabels(session.UserId)
+	return navData{Username: session.Username, Unread: unread, Requests: requests, Labels: labels}, err
+}
+
+/*
+	makeMailboxData
+
+Takes a page of mail for a mailbox, and returns its previews for the mailbox templates.
+The caller fills in navigation data.
+*/
+func makeMailboxData(req *http.Request, pageMails []InboxMail, pages pageData, mailDate time.Time) mailboxData {
+	// truncate the content of mail and construct previews
+	var previews []mailPreview
+
+	for _, m := range pageMails {
+		preview := mailPreview{MailId: m.MailId, FromName: m.FromName, Subject: m.Subject, Preview: trunc(markdownText(m.Content), 60),
+			Archived: m.Folder == "archive", Read: m.Read, Earlier: m.Earlier}
+		previews = append(previews, preview)
+	}
+
+	return mailboxData{Path: req.URL.RequestURI(), Date: mailDate.Format("Monday, Jan 2"), Day: mailDate.Format(urlDateFormat),
+		Mails: previews, pageData: pages}
+}
+
+/* toInboxMail: convert mail for a mailbox that doesn't count superseded mail */
+func toInboxMail(mails []Mail) []InboxMail {
+	var inboxMails []InboxMail
+	for _, m := range mails {
+		inboxMails = append(inboxMails, InboxMail{Mail: m})
+	}
+	return inboxMails
+}
+
 /* getMailbox: display inbox or archive */
 func getMailbox(writer http.ResponseWriter, req *http.Request, session SessionUser) {
 	mailDate := currDate()
+	cursor, page := parseCursor(req)
 	var err error
-	var mails []Mail
+	var mails []InboxMail
+	var pages pageData
 	if req.URL.Path == "/mail/folder/inbox/" {
-		mails, err = loadInbox(session.UserId, mailDate.Unix())
+		var inbox Page[InboxMail]
+		inbox, err = loadInbox(session.UserId, mailDate.Unix(), cursor)
+		mails, pages = inbox.Rows, makePageData(inbox, page)
 	} else if req.URL.Path == "/mail/folder/archive/" {
-		mails, err = loadArchive(session.UserId, mailDate.Unix())
+		var archive Page[Mail]
+		archive, err = loadArchive(session.UserId, mailDate.Unix(), cursor)
+		mails, pages = toInboxMail(archive.Rows), makePageData(archive, page)
 	} else {
 		internalError(writer, errors.New("unknown folder requested"))
 		return
@@ -139,46 +323,235 @@ func getMailbox(writer http.ResponseWriter, req *http.Request, session SessionUs
 		return
 	}
 
+	data := makeMailboxData(req, mails, pages, mailDate)
+	data.navData, err = loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	if req.URL.Path == "/mail/folder/inbox/" {
+		data.Reminders, data.NudgeDays, err = loadReminderPreviews(session, mailDate)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
+
+	renderPage(writer, req, data)
+}
+
+/*
+	loadReminderPreviews
+
+Loads the reminders to reply that are due in a day's inbox, and the user's nudge preference.
+*/
+func loadReminderPreviews(session SessionUser, mailDate time.Time) ([]reminderPreview, int, error) {
+	prefs, err := loadPreferences(session.UserId)
+	if err != nil {
+		return nil, 0, err
+	}
+	nudgeDate := mailDate.AddDate(0, 0, -prefs.NudgeDays)
+	reminders, err := loadDueReminders(session.UserId, strings.ToLower(session.Username+"@"+host), mailDate.Unix(),
+		prefs.NudgeDays, nudgeDate.Unix(), reminderLimit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var previews []reminderPreview
+	for _, r := range reminders {
+		previews = append(previews, reminderPreview{MailId: r.MailId, FromName: r.FromName, Subject: r.Subject, Nudge: r.Nudge,
+			Date: time.Unix(r.Date, 0).Format("Monday, Jan 2")})
+	}
+	return previews, prefs.NudgeDays, nil
+}
+
+/*
+	getLabelFolder
+
+Displays the conversations with a label, like the archive.
+*/
+func getLabelFolder(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	label, err := loadLabel(session.UserId, req.PathValue("labelId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	mailDate := currDate()
+	mails, err := loadLabelFolder(session.UserId, label.LabelId, mailDate.Unix())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	page, next := parsePages(req, len(mails))
+	pageMails := toInboxMail(mailsToPage(mails, page, next))
+	pages := pageData{PagePrev: page - 1, PageNext: next}
+
+	data := labelFolderData{mailboxData: makeMailboxData(req, pageMails, pages, mailDate), Label: *label}
+	data.navData, err = loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderTemplate(writer, "label", data)
+}
+
+/* getTrash: display trashed mail */
+func getTrash(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	mails, err := loadTrash(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
 	page, next := parsePages(req, len(mails))
 
 	pageMails := mailsToPage(mails, page, next)
 
-	// truncate the content of mail and construct previews
-	var previews []mailPreview
+	var previews []trashPreview
 
 	for _, m := range pageMails {
-		preview := mailPreview{MailId: m.MailId, FromName: m.FromName, Subject: m.Subject, Preview: trunc(m.Content, 60)}
+		purgeDate := time.Unix(m.TrashDate, 0).AddDate(0, 0, trashDays)
+		preview := trashPreview{MailId: m.MailId, FromName: m.FromName, Subject: m.Subject, Preview: trunc(markdownText(m.Content), 60),
+			PurgeDate: purgeDate.Format("Jan 2")}
 		previews = append(previews, preview)
 	}
 
-	renderPage(writer, req, mailboxData{Username: session.Username, Date: mailDate.Format("Monday, Jan 2"), Mails: previews,
-		PagePrev: page - 1, PageNext: next})
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderPage(writer, req, trashData{navData: nav, Mails: previews, Days: trashDays, pageData: pageData{PagePrev: page - 1, PageNext: next}})
 }
 
-func getDrafts(writer http.ResponseWriter, req *http.Request, session SessionUser) {
-	drafts, err := loadAllDrafts(session.UserId)
+/*
+	getRequests
+
+Displays held mail from senders the user doesn't know, one row per sender, and the
+setting for contacts-only mode.
+*/
+func getRequests(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	mailDate := currDate()
+	mails, err := loadRequests(session.UserId, mailDate.Unix())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	prefs, err := loadPreferences(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	page, next := parsePages(req, len(mails))
+	pages := pageData{PagePrev: page - 1, PageNext: next}
+
+	data := requestsData{mailboxData: makeMailboxData(req, mailsToPage(mails, page, next), pages, mailDate),
+		ContactsOnly: prefs.ContactsOnly}
+	data.navData, err = loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderPage(writer, req, data)
+}
+
+/* getBlocks: display the page to manage blocked senders */
+func getBlocks(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	blocks, err := loadBlocks(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderPage(writer, req, blocksData{navData: nav, Blocks: blocks})
+}
+
+/* getLabels: display the page to manage labels */
+func getLabels(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderPage(writer, req, labelsData{navData: nav})
+}
+
+func getTemplates(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	data, err := loadTemplatesData(session)
 	if err != nil {
 		internalError(writer, err)
 		return
 	}
 
-	page, next := parsePages(req, len(drafts))
+	renderPage(writer, req, data)
+}
+
+/* loadTemplatesData: load the data for the templates page, with signatures and letter templates apart */
+func loadTemplatesData(session SessionUser) (templatesData, error) {
+	nav, err := loadNav(session)
+	if err != nil {
+		return templatesData{}, err
+	}
+	letterTemplates, err := loadTemplates(session.UserId)
+	if err != nil {
+		return templatesData{}, err
+	}
+
+	data := templatesData{navData: nav}
+	for _, t := range letterTemplates {
+		if t.Kind == "signature" {
+			data.Signatures = append(data.Signatures, t)
+		} else {
+			data.Templates = append(data.Templates, t)
+		}
+	}
+	return data, nil
+}
 
-	pageMails := mailsToPage(drafts, page, next)
+func getDrafts(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	cursor, page := parseCursor(req)
+	drafts, err := loadDrafts(session.UserId, cursor)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
 
 	// truncate the content of mail and construct previews
 	var previews []draftPreview
 
-	for _, d := range pageMails {
+	for _, d := range drafts.Rows {
 		preview := draftPreview{DraftId: d.DraftId, Recipient: d.Recipient, Subject: d.Subject,
-			Preview: trunc(d.Content, 60)}
+			Preview: trunc(markdownText(d.Content), 60)}
 		previews = append(previews, preview)
 	}
 
 	mailDate := currDate()
 
-	renderPage(writer, req, draftsData{Username: session.Username, Date: mailDate.Format("Monday, Jan 2"), Mails: previews,
-		PagePrev: page - 1, PageNext: next})
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderPage(writer, req, draftsData{navData: nav, Date: mailDate.Format("Monday, Jan 2"), Mails: previews,
+		pageData: makePageData(drafts, page)})
 }
 
 /*
@@ -200,9 +573,20 @@ func getConv(writer http.ResponseWriter, req *http.Request, session SessionUser)
 		return
 	}
 
+	// contacts are shown by their nickname
+	contact, err := loadContactByAddr(session.UserId, sender.SenderAddr)
+	if err != nil && err != ErrNotFound {
+		internalError(writer, err)
+		return
+	}
+	if contact != nil && contact.Nickname != "" {
+		sender.SenderName = contact.Nickname
+	}
+
 	convDate := currDate().Unix()
 
-	mails, err := loadConv(session.UserId, sender.SenderAddr, convDate)
+	cursor, page := parseCursor(req)
+	mails, err := loadConv(session.UserId, sender.SenderAddr, convDate, cursor)
 	if err != nil {
 		internalError(writer, err)
 		return
@@ -213,25 +597,834 @@ func getConv(writer http.ResponseWriter, req *http.Request, session SessionUser)
 		return
 	}
 
-	page, next := parsePages(req, len(mails))
+	pages := makePageData(mails, page)
 	var draftDisplay *mailDisplay
-	if page == 1 && draft != nil {
+	if pages.PagePrev == 0 && draft != nil {
 		// only show the draft on first page
-		draftDisplay = &mailDisplay{Subject: draft.Subject, Content: draft.Content}
+		draftDisplay = &mailDisplay{Subject: draft.Subject, Content: draft.Content, PlainText: draft.PlainText}
+		draftDisplay.Attachments, err = loadAttachmentLinks(0, draft.DraftId)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
 	}
-	pageMails := mailsToPage(mails, page, next)
-
 	var displayMails []mailDisplay
 
-	for _, m := range pageMails {
-		display := mailDisplay{Date: time.Unix(m.Date, 0).Format("Monday, Jan 2, 2006"), Subject: m.Subject, Content: m.Content}
+	for _, m := range mails.Rows {
+		display := mailDisplay{MailId: m.MailId, Date: time.Unix(m.Date, 0).Format("Monday, Jan 2, 2006"), Subject: m.Subject,
+			Content: m.Content, Unread: !m.Read, Superseded: m.Superseded, PlainText: m.PlainText}
+		display.Attachments, err = loadAttachmentLinks(m.MailId, 0)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		if !display.PlainText {
+			display.HTML = renderMarkdown(m.Content)
+		}
 		displayMails = append(displayMails, display)
 	}
 
-	renderPage(writer, req, convData{Username: session.Username, MailId: mailId, SenderName: sender.SenderName, SenderAddr: sender.SenderAddr,
-		Draft: draftDisplay, Mails: displayMails, PagePrev: page - 1, PageNext: next})
+	archived, err := convArchived(session.UserId, sender.SenderAddr, convDate)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	convLabels, err := loadConvLabels(session.UserId, sender.SenderAddr)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = markConvRead(session.UserId, sender.SenderAddr, convDate)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	// every label the user has, checked if it is on this conversation
+	var labelChoices []labelChoice
+	for _, l := range nav.Labels {
+		choice := labelChoice{Label: l}
+		for _, cl := range convLabels {
+			if cl.LabelId == l.LabelId {
+				choice.Checked = true
+			}
+		}
+		labelChoices = append(labelChoices, choice)
+	}
+
+	letterTemplates, err := loadTemplates(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	var draftId int
+	if draft != nil {
+		draftId = draft.DraftId
+	}
+
+	var reminderDue string
+	reminder, err := loadReminder(session.UserId, sender.SenderAddr)
+	if err != nil && err != ErrNotFound {
+		internalError(writer, err)
+		return
+	}
+	if reminder != nil {
+		reminderDue = time.Unix(reminder.Due, 0).Format("Monday, Jan 2")
+	}
+
+	renderPage(writer, req, convData{navData: nav, Labels: labelChoices, Templates: letterTemplates, DraftId: draftId, Reminder: reminderDue, MailId: mailId, SenderName: sender.SenderName, SenderAddr: sender.SenderAddr,
+		Archived: archived, Draft: draftDisplay, Mails: displayMails, pageData: pages})
 }
 
-func getCompose(writer http.ResponseWriter, req *http.Request, session SessionUser) {
-	renderPage(writer, req, composeData{Username: session.Username})
+/*
+	getBook
+
+Downloads a conversation as a book, in the format given in the path: "epub", or "html" for
+a page laid out for printing.
+*/
+func getBook(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	format := req.PathValue("format")
+	contentType, ok := bookFormats[format]
+	if !ok {
+		http.NotFound(writer, req)
+		return
+	}
+	sender, err := loadSenderAddr(req.PathValue("mailId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	book, err := loadBook(session.UserId, session.DisplayName, sender, currDate().Unix())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	// the conversation is someone else's, or none of it is delivered yet
+	if len(book.Months) == 0 {
+		http.NotFound(writer, req)
+		return
+	}
+
+	var out bytes.Buffer
+	err = writeBook(&out, format, book)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	name, _, _ := strings.Cut(sender.SenderAddr, "@")
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "letters-from-" + name + "." + format}))
+	out.WriteTo(writer)
+}
+
+/* getDraftEdit: shows the compose page for a saved draft */
+func getDraftEdit(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	draft, err := loadDraftById(session.UserId, req.PathValue("draftId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	attachments, err := loadAttachmentLinks(0, draft.DraftId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	letterTemplates, err := loadTemplates(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderTemplate(writer, "compose", composeData{navData: nav, Templates: letterTemplates, DraftId: draft.DraftId,
+		Attachments: attachments, To: draft.Recipient, Subject: draft.Subject, Content: draft.Content, PlainText: draft.PlainText})
+}
+
+/* getRevisions: shows the earlier revisions of a draft, to restore one */
+func getRevisions(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	draft, err := loadDraftById(session.UserId, req.PathValue("draftId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	revisions, err := loadRevisions(session.UserId, draft.DraftId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	prefs, err := loadPreferences(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	loc := userLocation(prefs.TimeZone)
+
+	var displays []revisionDisplay
+	for _, r := range revisions {
+		displays = append(displays, revisionDisplay{RevisionId: r.RevisionId, Date: time.Unix(r.Date, 0).In(loc).Format("Jan 2, 2006 at 3:04 PM"),
+			Subject: r.Subject, Content: r.Content})
+	}
+
+	renderPage(writer, req, revisionsData{navData: nav, Draft: *draft, Revisions: displays})
+}
+
+func getContacts(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	data, err := loadContactsData(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderPage(writer, req, data)
+}
+
+/* loadContactsData: load the data for the address book page */
+func loadContactsData(session SessionUser) (contactsData, error) {
+	nav, err := loadNav(session)
+	if err != nil {
+		return contactsData{}, err
+	}
+	contacts, err := loadContacts(session.UserId)
+	if err != nil {
+		return contactsData{}, err
+	}
+	suggestions, err := loadSuggestedContacts(session.UserId, currDate().Unix(), suggestedContacts)
+	if err != nil {
+		return contactsData{}, err
+	}
+
+	return contactsData{navData: nav, Contacts: contacts, Suggestions: suggestions}, nil
+}
+
+/* getContactsExport: downloads the user's contacts as a vCard file */
+func getContactsExport(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	contacts, err := loadContacts(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "contacts.vcf"}))
+	err = writeVCards(writer, contacts)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// time zones offered on the account page. Any other IANA zone name can be typed in.
+var suggestedTimeZones = []string{"UTC", "America/Los_Angeles", "America/Denver", "America/Chicago", "America/New_York",
+	"America/Sao_Paulo", "Europe/London", "Europe/Paris", "Europe/Berlin", "Africa/Lagos", "Africa/Johannesburg",
+	"Asia/Kolkata", "Asia/Shanghai", "Asia/Tokyo", "Australia/Sydney", "Pacific/Auckland"}
+
+/* getAccount: shows the account settings page */
+func getAccount(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	data, err := loadAccountData(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	data.Saved = req.URL.Query().Has("saved")
+
+	renderTemplate(writer, "account", data)
+}
+
+/*
+	getRecoveryConfirm
+
+Confirms a new recovery address from the link sent to it. The link doesn't need the user to
+be logged in, since the token in it is only known to someone who can read that address.
+*/
+func getRecoveryConfirm(writer http.ResponseWriter, req *http.Request) {
+	if transport == nil {
+		http.NotFound(writer, req)
+		return
+	}
+	// the token is in the path, so it shouldn't be sent on to any other site
+	writer.Header().Set("Referrer-Policy", "no-referrer")
+
+	err := confirmRecovery(hashResetToken(req.PathValue("token")), time.Now().Unix())
+	if err != nil && err != ErrNotFound {
+		internalError(writer, err)
+		return
+	}
+	renderTemplate(writer, "recoveryconfirm", recoveryConfirmData{Invalid: err == ErrNotFound})
+}
+
+/* loadAccountData: loads the saved account settings of the session's user */
+func loadAccountData(session SessionUser) (accountData, error) {
+	user, err := loadUser(session.Username)
+	if err != nil {
+		return accountData{}, err
+	}
+	var pendingRecovery string
+	pending, err := loadPendingRecovery(session.UserId, time.Now().Unix())
+	if err != nil && err != ErrNotFound {
+		return accountData{}, err
+	}
+	if pending != nil {
+		pendingRecovery = pending.Addr
+	}
+	prefs, err := loadPreferences(session.UserId)
+	if err != nil {
+		return accountData{}, err
+	}
+	nav, err := loadNav(session)
+	if err != nil {
+		return accountData{}, err
+	}
+
+	return accountData{navData: nav, DisplayName: user.DisplayName, RecoveryAddr: user.RecoveryAddr, PendingRecovery: pendingRecovery, TimeZone: prefs.TimeZone,
+		ContactsOnly: prefs.ContactsOnly, NudgeDays: prefs.NudgeDays, TimeZones: suggestedTimeZones}, nil
+}
+
+/*
+	getStats
+
+Shows statistics of the user's letters. The page also has a summary of the year before, the
+"year in letters", which is shown all through the following year.
+*/
+func getStats(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	data, err := loadStatsData(session, currDate())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderPage(writer, req, data)
+}
+
+/* loadStatsData: load the data for the statistics page */
+func loadStatsData(session SessionUser, today time.Time) (statsData, error) {
+	nav, err := loadNav(session)
+	if err != nil {
+		return statsData{}, err
+	}
+	data := statsData{navData: nav}
+
+	// letters written since the last delivery count as sent
+	all := StatsRange{UserId: session.UserId, Addr: strings.ToLower(session.Username + "@" + host), Today: today.Unix(),
+		Before: time.Now().Unix() + 1}
+
+	lastYear := all
+	lastYear.After = time.Date(today.Year(), today.Month()-11, 1, 0, 0, 0, 0, time.Local).Unix()
+	months, err := loadMonthCounts(lastYear)
+	if err != nil {
+		return data, err
+	}
+	for _, m := range months {
+		data.Months = append(data.Months, monthDisplay{Month: formatMonth(m.Month, "January 2006"), Received: m.Received, Sent: m.Sent})
+	}
+
+	data.Correspondents, err = loadTopCorrespondents(all, topCorrespondents)
+	if err != nil {
+		return data, err
+	}
+
+	replyTimes, err := loadReplyTimes(all)
+	if err != nil {
+		return data, err
+	}
+	for _, r := range replyTimes {
+		if r.Sent {
+			data.ReplyDays = formatDays(r.Days)
+		} else {
+			data.PalReplyDays = formatDays(r.Days)
+		}
+	}
+
+	data.ReceivedStreak, err = loadStreakDisplay(all, false)
+	if err != nil {
+		return data, err
+	}
+	data.SentStreak, err = loadStreakDisplay(all, true)
+	if err != nil {
+		return data, err
+	}
+
+	data.Year, err = loadYearInLetters(all, today.Year()-1)
+	return data, err
+}
+
+/* loadStreakDisplay: load the longest streak of letters received or sent, or nil if there are none */
+func loadStreakDisplay(r StatsRange, sent bool) (*streakDisplay, error) {
+	streak, err := loadLongestStreak(r, sent)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start, _ := time.Parse(urlDateFormat, streak.Start)
+	end, _ := time.Parse(urlDateFormat, streak.End)
+	return &streakDisplay{Days: streak.Days, Start: start.Format("Jan 2, 2006"), End: end.Format("Jan 2, 2006")}, nil
+}
+
+/*
+	loadYearInLetters
+
+Summarizes the letters of a past year. Returns nil if the user had no letters that year.
+*/
+func loadYearInLetters(all StatsRange, year int) (*yearInLetters, error) {
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local)
+	yearRange := all
+	yearRange.After, yearRange.Before = start.Unix(), start.AddDate(1, 0, 0).Unix()
+
+	months, err := loadMonthCounts(yearRange)
+	if err != nil || len(months) == 0 {
+		return nil, err
+	}
+
+	summary := yearInLetters{Year: year}
+	busiest := 0
+	for _, m := range months {
+		summary.Received += m.Received
+		summary.Sent += m.Sent
+		if m.Received+m.Sent > busiest {
+			busiest = m.Received + m.Sent
+			summary.BusiestMonth = formatMonth(m.Month, "January")
+		}
+	}
+
+	// people are new if their first letter ever is in the year
+	untilEnd := all
+	untilEnd.Before = yearRange.Before
+	summary.NewCorrespondents, err = countNewCorrespondents(untilEnd, yearRange.After)
+	if err != nil {
+		return nil, err
+	}
+
+	summary.Top, err = loadTopCorrespondents(yearRange, yearTopCorrespondents)
+	return &summary, err
+}
+
+/* formatMonth: formats a month given as 2006-01 */
+func formatMonth(month string, layout string) string {
+	parsed, err := time.Parse("2006-01", month)
+	if err != nil {
+		return month
+	}
+	return parsed.Format(layout)
+}
+
+/* formatDays: formats a number of days, to a tenth of a day */
+func formatDays(days float64) string {
+	return strconv.FormatFloat(days, 'f', 1, 64) + " days"
+}
+
+// an address suggested for the "To:" field of the compose page
+type addressMatch struct {
+	Addr string `json:"addr"`
+	Name string `json:"name"`
+}
+
+/*
+	getAutocomplete
+
+Responds with JSON addresses for the "To:" field, matching the `q` query parameter.
+Contacts come first, then other addresses the user has received mail from.
+*/
+func getAutocomplete(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	matches := []addressMatch{}
+	prefix := strings.TrimSpace(req.FormValue("q"))
+	if prefix != "" {
+		senders, err := loadAddressMatches(session.UserId, prefix, currDate().Unix(), autocompleteMatches)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		for _, s := range senders {
+			matches = append(matches, addressMatch{Addr: s.SenderAddr, Name: s.SenderName})
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(matches)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+	getDirectory
+
+Shows the pen-pal directory of other users who have listed themselves, filtered by the `q`
+(words in the bio or interests) and `language` query parameters.
+*/
+func getDirectory(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	data := directoryData{Query: strings.TrimSpace(req.FormValue("q")), Language: req.FormValue("language")}
+
+	listing, err := loadListing(session.UserId)
+	if err != nil && err != ErrNotFound {
+		internalError(writer, err)
+		return
+	}
+	data.Listing = listing
+
+	cursor, page := parseCursor(req)
+	entries, err := loadDirectory(session.UserId, data.Query, data.Language, cursor)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	for _, e := range entries.Rows {
+		data.Entries = append(data.Entries, directoryEntry{Name: e.DisplayName, Addr: e.Username + "@" + host,
+			Bio: e.Bio, Interests: e.Interests, Language: e.Language})
+	}
+	data.pageData = makePageData(entries, page)
+	data.PageQuery = url.Values{"q": {data.Query}, "language": {data.Language}}.Encode()
+
+	data.Languages, err = loadDirectoryLanguages()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	data.navData, err = loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderPage(writer, req, data)
+}
+
+/*
+	getForward
+
+Shows the compose page with a delivered letter quoted, to forward it to a new recipient.
+Saving or sending it goes through the usual compose routes.
+*/
+func getForward(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	mail, err := loadDeliveredMail(session.UserId, req.PathValue("mailId"), currDate().Unix())
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	letterTemplates, err := loadTemplates(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderTemplate(writer, "compose", composeData{navData: nav, Templates: letterTemplates, Subject: "Fwd: " + mail.Subject,
+		Content: quoteForward(mail), PlainText: mail.PlainText})
+}
+
+/* quoteForward: the text of a forwarded letter, quoted below a line saying who wrote it and when */
+func quoteForward(mail *Mail) string {
+	var quoted []string
+	for _, line := range strings.Split(strings.ReplaceAll(mail.Content, "\r\n", "\n"), "\n") {
+		quoted = append(quoted, strings.TrimRight("> "+line, " "))
+	}
+
+	from := mail.FromAddr
+	if mail.FromName != "" {
+		from = mail.FromName + " <" + mail.FromAddr + ">"
+	}
+	return "\n\n---------- Forwarded letter ----------\n" +
+		"From: " + from + "\n" +
+		"Date: " + time.Unix(mail.Date, 0).Format("Monday, Jan 2, 2006") + "\n" +
+		"Subject: " + mail.Subject + "\n\n" +
+		strings.Join(quoted, "\n")
+}
+
+/*
+	formatSize
+
+Formats a size in bytes for display, in the largest unit that keeps it at least 1.
+*/
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
+
+/* loadAttachmentLinks: the attachments on a mail or a draft, for display. Set the id of the other one to 0. */
+func loadAttachmentLinks(mailId int, draftId int) ([]attachmentLink, error) {
+	attachments, err := loadAttachmentList(mailId, draftId)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []attachmentLink
+	for _, a := range attachments {
+		links = append(links, attachmentLink{AttachmentId: a.AttachmentId, Filename: a.Filename, Size: formatSize(a.Size)})
+	}
+	return links, nil
+}
+
+/*
+	getAttachment
+
+Downloads an attachment. Attachments on mail can't be downloaded before the mail is delivered.
+The attachment is always served as a download with its sniffed type, so it can't be shown
+as a page on this site.
+*/
+func getAttachment(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	attachment, err := loadAttachment(session.UserId, req.PathValue("attachmentId"), currDate().Unix())
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", attachment.MimeType)
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	writer.Write(attachment.Data)
+}
+
+func getCompose(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	letterTemplates, err := loadTemplates(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	// the recipient can be filled in from a link, e.g. in the pen-pal directory
+	renderPage(writer, req, composeData{navData: nav, Templates: letterTemplates, To: req.FormValue("to")})
+}
+
+/*
+	ftsQuery
+
+Turns search box input into an FTS5 query that matches mail containing every word.
+Each word is quoted, so FTS5 syntax in the input is searched for literally instead of
+causing a query error.
+*/
+func ftsQuery(input string) string {
+	var terms []string
+	for _, word := range strings.Fields(input) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+/*
+	highlightSnippet
+
+Escapes a snippet from searchMail and replaces its match markers with <mark> tags.
+*/
+func highlightSnippet(snippet string) template.HTML {
+	escaped := template.HTMLEscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, "\x02", "<mark>")
+	escaped = strings.ReplaceAll(escaped, "\x03", "</mark>")
+	return template.HTML(escaped)
+}
+
+// format of dates in URLs
+const urlDateFormat = "2006-01-02"
+
+/*
+	parseDateParam
+
+Parses a date query parameter in the form 2006-01-02, as midnight local time.
+Returns ok = false if the parameter is missing or invalid.
+*/
+func parseDateParam(req *http.Request, name string) (time.Time, bool) {
+	date, err := time.ParseInLocation(urlDateFormat, req.FormValue(name), time.Local)
+	return date, err == nil
+}
+
+/*
+	getSearch
+
+Searches delivered mail. Filters are query parameters: `q` for the search words, `from`
+for a sender address, and `after` and `before` for a range of delivery dates. Mail
+delivered after today is never searched.
+*/
+func getSearch(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	today := currDate()
+
+	// offer every sender as a filter
+	senders, err := loadSenders(session.UserId, today.Unix())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	data := searchData{Query: req.FormValue("q"), From: req.FormValue("from"), After: req.FormValue("after"),
+		Before: req.FormValue("before"), Senders: senders}
+
+	terms := ftsQuery(data.Query)
+	if terms != "" {
+		data.Searched = true
+
+		var after int64
+		if date, ok := parseDateParam(req, "after"); ok {
+			after = date.Unix()
+		}
+		before := today
+		if date, ok := parseDateParam(req, "before"); ok && date.Before(today) {
+			before = date
+		}
+
+		results, err := searchMail(session.UserId, terms, data.From, after, before.Unix())
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+
+		page, next := parsePages(req, len(results))
+		for _, r := range mailsToPage(results, page, next) {
+			data.Results = append(data.Results, searchResult{MailId: r.MailId, FromName: r.FromName, Subject: r.Subject,
+				Date: time.Unix(r.Date, 0).Format("Jan 2, 2006"), Snippet: highlightSnippet(r.Snippet)})
+		}
+		data.PagePrev = page - 1
+		data.PageNext = next
+		data.PageQuery = url.Values{"q": {data.Query}, "from": {data.From}, "after": {data.After},
+			"before": {data.Before}}.Encode()
+	}
+
+	data.navData, err = loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderPage(writer, req, data)
+}
+
+/*
+	makeCalendar
+
+Builds a calendar of the month containing `day`, marking the days when the user received
+mail. Weeks start on Sunday, and days after `today` have no links.
+*/
+func makeCalendar(userId int, day time.Time, today time.Time) (calendarData, error) {
+	first := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.Local)
+	next := first.AddDate(0, 1, 0)
+
+	deliveryDays, err := loadDeliveryDays(userId, first.Unix(), next.Unix())
+	if err != nil {
+		return calendarData{}, err
+	}
+	hasMail := make(map[int64]bool)
+	for _, d := range deliveryDays {
+		hasMail[d.Date] = true
+	}
+
+	// blank days before the first of the month
+	week := make([]calendarDay, first.Weekday())
+	var weeks [][]calendarDay
+	for d := first; d.Before(next); d = d.AddDate(0, 0, 1) {
+		week = append(week, calendarDay{Day: d.Day(), Link: d.Format(urlDateFormat), HasMail: hasMail[d.Unix()],
+			Selected: d.Equal(day), Future: d.After(today)})
+		if len(week) == 7 {
+			weeks = append(weeks, week)
+			week = nil
+		}
+	}
+	if week != nil {
+		weeks = append(weeks, week)
+	}
+
+	cal := calendarData{Month: first.Format("January 2006"), Weeks: weeks,
+		PrevMonth: first.AddDate(0, -1, 0).Format(urlDateFormat)}
+	if !next.After(today) {
+		cal.NextMonth = next.Format(urlDateFormat)
+	}
+	return cal, nil
+}
+
+/*
+	getDay
+
+Displays the mail delivered on a past day, given in the path as 2006-01-02, including
+conversations that were archived since, with links to nearby days and a calendar of the
+month. Days after today are not found.
+*/
+func getDay(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	today := currDate()
+	day, err := time.ParseInLocation(urlDateFormat, req.PathValue("date"), time.Local)
+	if err != nil || day.After(today) {
+		http.NotFound(writer, req)
+		return
+	}
+
+	cursor, page := parseCursor(req)
+	mails, err := loadDay(session.UserId, day.Unix(), cursor)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	data := dayData{mailboxData: makeMailboxData(req, mails.Rows, makePageData(mails, page), day), PrevDay: day.AddDate(0, 0, -1).Format(urlDateFormat)}
+	if day.Before(today) {
+		data.NextDay = day.AddDate(0, 0, 1).Format(urlDateFormat)
+	}
+
+	data.Calendar, err = makeCalendar(session.UserId, day, today)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	data.navData, err = loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderTemplate(writer, "day", data)
 }
@@ -3,6 +3,10 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	sqlite "github.com/mattn/go-sqlite3"
 )
@@ -36,6 +40,7 @@ type Mail struct {
 	Content   string
 	MultiFrom bool
 	MultiTo   bool
+	PlainText bool // the author chose plain text instead of Markdown
 }
 
 // draft record
@@ -45,6 +50,17 @@ type Draft struct {
 	Recipient string
 	Subject   string
 	Content   string
+	PlainText bool
+}
+
+// an earlier version of a draft
+type DraftRevision struct {
+	RevisionId int
+	DraftId    int
+	UserId     int
+	Date       int64
+	Subject    string
+	Content    string
 }
 
 // user record
@@ -76,11 +92,287 @@ type Session struct {
 	Expiration int64
 }
 
+// password reset record. Only a hash of the token is stored, since the token is as good as a password.
+type PasswordReset struct {
+	TokenHash  []byte
+	UserId     int
+	Expiration int64
+}
+
+// a new recovery address waiting to be confirmed, with a hash of the token in the link sent to it
+type RecoveryConfirmation struct {
+	TokenHash  []byte
+	UserId     int
+	Addr       string
+	Expiration int64
+}
+
+// user preferences record
+type Preferences struct {
+	UserId       int
+	ContactsOnly bool
+	NudgeDays    int    // days after which unanswered letters are shown as reminders, or 0 for never
+	TimeZone     string // IANA name of the zone that times are shown in, or empty for the server's
+}
+
+// mail record for the trash, with when it was trashed
+type TrashMail struct {
+	Mail
+	TrashDate int64
+}
+
+// blocked address or domain record
+type Block struct {
+	UserId  int
+	Blocked string
+}
+
+// label record
+type Label struct {
+	LabelId int
+	UserId  int
+	Name    string
+}
+
+// a signature or a letter template, with text to insert into letters
+type LetterTemplate struct {
+	TemplateId int
+	UserId     int
+	Kind       string // "signature" or "template"
+	Name       string
+	Content    string
+}
+
+func (t *LetterTemplate) ToPtrSlice() []any {
+	return []any{&t.TemplateId, &t.UserId, &t.Kind, &t.Name, &t.Content}
+}
+
+// a saved address in a user's address book
+type Contact struct {
+	ContactId int
+	UserId    int
+	Addr      string
+	Nickname  string
+	Notes     string
+}
+
+func (c *Contact) ToPtrSlice() []any {
+	return []any{&c.ContactId, &c.UserId, &c.Addr, &c.Nickname, &c.Notes}
+}
+
+// an address the user has received mail from, suggested as a contact
+type SuggestedContact struct {
+	Addr  string
+	Name  string
+	Count int // mail received from the address
+}
+
+func (c *SuggestedContact) ToPtrSlice() []any {
+	return []any{&c.Addr, &c.Name, &c.Count}
+}
+
+// letters received and sent in a month, given as 2006-01
+type MonthCount struct {
+	Month    string
+	Received int
+	Sent     int
+}
+
+func (m *MonthCount) ToPtrSlice() []any {
+	return []any{&m.Month, &m.Received, &m.Sent}
+}
+
+// someone a user has exchanged letters with, and how many each way
+type Correspondent struct {
+	Addr     string
+	Name     string
+	Received int
+	Sent     int
+}
+
+func (c *Correspondent) ToPtrSlice() []any {
+	return []any{&c.Addr, &c.Name, &c.Received, &c.Sent}
+}
+
+// average time taken to answer a letter, either by the user (Sent) or by the people they write to
+type ReplyTime struct {
+	Sent bool
+	Days float64
+}
+
+func (r *ReplyTime) ToPtrSlice() []any {
+	return []any{&r.Sent, &r.Days}
+}
+
+// consecutive days with a letter, with the first and last days given as 2006-01-02
+type Streak struct {
+	Days  int
+	Start string
+	End   string
+}
+
+func (s *Streak) ToPtrSlice() []any {
+	return []any{&s.Days, &s.Start, &s.End}
+}
+
+// a reminder to reply to a conversation, which is due on a delivery day
+type Reminder struct {
+	UserId     int
+	SenderAddr string
+	Due        int64
+}
+
+func (r *Reminder) ToPtrSlice() []any {
+	return []any{&r.UserId, &r.SenderAddr, &r.Due}
+}
+
+// a letter a user sent to another user, kept for the statistics page
+type SentLetter struct {
+	UserId        int
+	RecipientAddr string // in lower case
+	RecipientName string
+	OrigDate      int64
+	Date          int64
+}
+
+func (s *SentLetter) ToPtrSlice() []any {
+	return []any{&s.UserId, &s.RecipientAddr, &s.RecipientName, &s.OrigDate, &s.Date}
+}
+
+// a conversation to reply to, shown in the inbox: either a reminder the user set, or a
+// nudge about an unanswered letter. Date is the reminder's due date or the letter's delivery date.
+type DueReminder struct {
+	MailId   int // latest delivered mail in the conversation
+	FromAddr string
+	FromName string
+	Subject  string
+	Date     int64
+	Nudge    bool
+}
+
+func (r *DueReminder) ToPtrSlice() []any {
+	return []any{&r.MailId, &r.FromAddr, &r.FromName, &r.Subject, &r.Date, &r.Nudge}
+}
+
+// a user's listing in the pen-pal directory
+type Listing struct {
+	UserId    int
+	Bio       string
+	Interests string
+	Language  string
+}
+
+func (l *Listing) ToPtrSlice() []any {
+	return []any{&l.UserId, &l.Bio, &l.Interests, &l.Language}
+}
+
+// a listing with the user's name, for browsing the directory
+type DirectoryEntry struct {
+	Listing
+	Username    string
+	DisplayName string
+}
+
+func (e *DirectoryEntry) ToPtrSlice() []any {
+	return append(e.Listing.ToPtrSlice(), &e.Username, &e.DisplayName)
+}
+
+// a language that listings in the pen-pal directory are written in
+type Language struct {
+	Name string
+}
+
+func (l *Language) ToPtrSlice() []any {
+	return []any{&l.Name}
+}
+
 type Sender struct {
 	SenderAddr string
 	SenderName string
 }
 
+// mail record for the inbox, with a count of the sender's earlier mail that it superseded
+type InboxMail struct {
+	Mail
+	Earlier int
+}
+
+// mail in a conversation, marked if a later mail from the same sender was delivered the same day
+type ConvMail struct {
+	Mail
+	Superseded bool
+}
+
+// mail found by a search, with a snippet of the matching text
+type SearchResult struct {
+	MailId   int
+	FromName string
+	FromAddr string
+	Subject  string
+	Date     int64
+	Snippet  string
+}
+
+// a day when mail was delivered, as midnight in Unix seconds
+type DeliveryDay struct {
+	Date int64
+}
+
+// attachment record. It belongs to either a mail or a draft, and the other id is 0.
+type Attachment struct {
+	AttachmentId int
+	UserId       int // owner: the recipient of a mail, or the author of a draft
+	MailId       int
+	DraftId      int
+	Filename     string
+	MimeType     string
+	Size         int64
+	Data         []byte
+}
+
+// result of a count(*) query
+type Count struct {
+	N int
+}
+
+/*
+	PageCursor
+
+Where a page loaded by loadPage starts. Links to other pages pass the key of a row on the
+page they are from: the next page starts after its last row, and the previous page ends
+before its first row. With no key, the page starts at an offset instead.
+*/
+type PageCursor struct {
+	Key    []any
+	Back   bool // the page ends before Key, instead of starting after it
+	Offset int
+}
+
+// a page of rows loaded by loadPage, with the keys of its first and last rows if there are rows before or after it
+type Page[V any] struct {
+	Rows    []V
+	PrevKey []any
+	NextKey []any
+}
+
+// SQL condition on a row of the mail table, true if the user blocked its sender's address or domain
+const fromBlocked = `exists (
+    select 1 from blocks
+    where blocks.user_id = mail.user_id and blocks.blocked in (
+        lower(mail.from_addr), lower(substr(mail.from_addr, instr(mail.from_addr, '@') + 1))
+    )
+)`
+
+/*
+	deliveryDate
+
+SQL expression for the day a row of the mail table, named `table` in the query, is delivered
+to its user. This is its `date`, unless the user snoozed it to a later day.
+*/
+func deliveryDate(table string) string {
+	return "coalesce((select until from snoozes where snoozes.mail_id = " + table + ".mail_id), " + table + ".date)"
+}
+
 // errors
 var (
 	ErrNotFound        = errors.New("query returned nothing from the database")
@@ -94,14 +386,58 @@ func (s *Sender) ToPtrSlice() []any {
 	return []any{&s.SenderAddr, &s.SenderName}
 }
 
+func (m *InboxMail) ToPtrSlice() []any {
+	return append(m.Mail.ToPtrSlice(), &m.Earlier)
+}
+
+func (m *ConvMail) ToPtrSlice() []any {
+	return append(m.Mail.ToPtrSlice(), &m.Superseded)
+}
+
+func (r *SearchResult) ToPtrSlice() []any {
+	return []any{&r.MailId, &r.FromName, &r.FromAddr, &r.Subject, &r.Date, &r.Snippet}
+}
+
+func (p *Preferences) ToPtrSlice() []any {
+	return []any{&p.UserId, &p.ContactsOnly, &p.NudgeDays, &p.TimeZone}
+}
+
+func (m *TrashMail) ToPtrSlice() []any {
+	return append(m.Mail.ToPtrSlice(), &m.TrashDate)
+}
+
+func (b *Block) ToPtrSlice() []any {
+	return []any{&b.UserId, &b.Blocked}
+}
+
+func (l *Label) ToPtrSlice() []any {
+	return []any{&l.LabelId, &l.UserId, &l.Name}
+}
+
+func (d *DeliveryDay) ToPtrSlice() []any {
+	return []any{&d.Date}
+}
+
+func (a *Attachment) ToPtrSlice() []any {
+	return []any{&a.AttachmentId, &a.UserId, &a.MailId, &a.DraftId, &a.Filename, &a.MimeType, &a.Size, &a.Data}
+}
+
+func (c *Count) ToPtrSlice() []any {
+	return []any{&c.N}
+}
+
 func (m *Mail) ToPtrSlice() []any {
 	return []any{&m.MailId, &m.UserId, &m.Folder, &m.Read, &m.OrigDate, &m.Date, &m.FromHead, &m.FromName,
 		&m.FromAddr, &m.ToHead, &m.MessageId, &m.InReplyTo,
-		&m.Subject, &m.Content, &m.MultiFrom, &m.MultiTo}
+		&m.Subject, &m.Content, &m.MultiFrom, &m.MultiTo, &m.PlainText}
 }
 
 func (d *Draft) ToPtrSlice() []any {
-	return []any{&d.DraftId, &d.UserId, &d.Recipient, &d.Subject, &d.Content}
+	return []any{&d.DraftId, &d.UserId, &d.Recipient, &d.Subject, &d.Content, &d.PlainText}
+}
+
+func (r *DraftRevision) ToPtrSlice() []any {
+	return []any{&r.RevisionId, &r.DraftId, &r.UserId, &r.Date, &r.Subject, &r.Content}
 }
 
 func (u *User) ToPtrSlice() []any {
@@ -116,6 +452,14 @@ func (s *SessionUser) ToPtrSlice() []any {
 	return []any{&s.SessionId, &s.UserId, &s.Username, &s.DisplayName, &s.StartDate, &s.Ip, &s.Expiration}
 }
 
+func (r *PasswordReset) ToPtrSlice() []any {
+	return []any{&r.TokenHash, &r.UserId, &r.Expiration}
+}
+
+func (c *RecoveryConfirmation) ToPtrSlice() []any {
+	return []any{&c.TokenHash, &c.UserId, &c.Addr, &c.Expiration}
+}
+
 func connectDb(dbPath string) error {
 	var err error
 	db, err = sql.Open("sqlite3", dbPath)
@@ -221,6 +565,19 @@ func loadUser(username string) (*User, error) {
 	return &user, err
 }
 
+/* updateAccount: save a user's display name and recovery address, which is removed if empty */
+func updateAccount(user User) error {
+	query := `update users set display_name = ?, recovery_addr = nullif(?, '') where user_id = ?`
+	_, err := db.Exec(query, user.DisplayName, user.RecoveryAddr, user.UserId)
+	return err
+}
+
+/* updatePassword: replace a user's password hash */
+func updatePassword(userId int, password []byte) error {
+	_, err := db.Exec(`update users set password = ? where user_id = ?`, password, userId)
+	return err
+}
+
 /*
 	newSession: insert a session
 
@@ -260,16 +617,229 @@ func loadSession(sessionId string) (*SessionUser, error) {
 	return &session, err
 }
 
+/* deleteOtherSessions: log a user out everywhere except the session with the given id */
+func deleteOtherSessions(userId int, sessionId string) error {
+	_, err := db.Exec("delete from sessions where user_id = ? and session_id != ?", userId, sessionId)
+	return err
+}
+
+/*
+	newPasswordReset
+
+Saves a password reset token. Any earlier token for the user stops working, so only the
+latest link that was sent can be used. Expired tokens of all users are deleted too.
+*/
+func newPasswordReset(reset PasswordReset, now int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	_, err = tx.Exec("delete from password_resets where user_id = ? or expiration <= ?", reset.UserId, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into password_resets values (?, ?, ?)", reset.ToPtrSlice()...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/* hasRecentReset: whether a user has a password reset token that expires after `after` */
+func hasRecentReset(userId int, after int64) (bool, error) {
+	query := "select count(*) from password_resets where user_id = ? and expiration > ?"
+
+	var count Count
+	err := loadSingleRow(query, []any{userId, after}, &count)
+	return count.N > 0, err
+}
+
+/* loadPasswordReset: loads a password reset token that hasn't expired, or returns ErrNotFound */
+func loadPasswordReset(tokenHash []byte, now int64) (*PasswordReset, error) {
+	query := "select token_hash, user_id, expiration from password_resets where token_hash = ? and expiration > ?"
+
+	var reset PasswordReset
+	err := loadSingleRow(query, []any{tokenHash, now}, &reset)
+	if err != nil {
+		return nil, err
+	}
+	return &reset, nil
+}
+
+/*
+	completePasswordReset
+
+Uses up a password reset token to set a new password hash, and logs the user out of all
+their sessions. Returns ErrNotFound if the token is unknown, used or expired.
+*/
+func completePasswordReset(tokenHash []byte, now int64, password []byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	var userId int
+	err = tx.QueryRow("select user_id from password_resets where token_hash = ? and expiration > ?", tokenHash, now).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("update users set password = ? where user_id = ?", password, userId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from sessions where user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from password_resets where user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+	newRecoveryConfirmation
+
+Saves a new recovery address that is waiting to be confirmed. It replaces any earlier one
+of the user's, so only the latest link that was sent can be used. Expired ones of all users
+are deleted too.
+*/
+func newRecoveryConfirmation(confirmation RecoveryConfirmation, now int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	_, err = tx.Exec("delete from recovery_confirmations where user_id = ? or expiration <= ?", confirmation.UserId, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into recovery_confirmations values (?, ?, ?, ?)", confirmation.ToPtrSlice()...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/* loadPendingRecovery: loads a user's recovery address waiting to be confirmed, or returns ErrNotFound */
+func loadPendingRecovery(userId int, now int64) (*RecoveryConfirmation, error) {
+	query := "select token_hash, user_id, addr, expiration from recovery_confirmations where user_id = ? and expiration > ?"
+
+	var confirmation RecoveryConfirmation
+	err := loadSingleRow(query, []any{userId, now}, &confirmation)
+	if err != nil {
+		return nil, err
+	}
+	return &confirmation, nil
+}
+
+/* deletePendingRecovery: stops a user's recovery address that is waiting to be confirmed from being confirmed */
+func deletePendingRecovery(userId int) error {
+	_, err := db.Exec("delete from recovery_confirmations where user_id = ?", userId)
+	return err
+}
+
+/*
+	confirmRecovery
+
+Uses up a token from a confirmation link to make its address the user's recovery address.
+Returns ErrNotFound if the token is unknown, used or expired.
+*/
+func confirmRecovery(tokenHash []byte, now int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	var userId int
+	var addr string
+	err = tx.QueryRow("select user_id, addr from recovery_confirmations where token_hash = ? and expiration > ?", tokenHash, now).
+		Scan(&userId, &addr)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("update users set recovery_addr = ? where user_id = ?", addr, userId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from recovery_confirmations where user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 /*
 	newMail
 
-Save a new mail. Returns database driver errors.
+Save a new mail, and add it to the search index. Returns the mail id generated by the
+database, and database driver errors. The mail is saved with its attachments in one
+transaction, so it is never saved with only some of them.
+
+Params:
+- uploads: new attachments, which are saved to the mail's owner
+- draftId: draft whose attachments move to the mail and its owner, or 0
 */
-func newMail(mail Mail) error {
-	query := `insert into mail values (null, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+func newMail(mail Mail, uploads []Attachment, draftId int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	query := `insert into mail values (null, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	mailFields := mail.ToPtrSlice()[1:] // remove mailId
-	_, err := db.Exec(query, mailFields...)
-	return err
+	result, err := tx.Exec(query, mailFields...)
+	if err != nil {
+		return 0, err
+	}
+	mailId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	query = `insert into mail_fts (rowid, subject, content, from_name) values (?, ?, ?, ?)`
+	_, err = tx.Exec(query, mailId, mail.Subject, mail.Content, mail.FromName)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, a := range uploads {
+		a.UserId = mail.UserId
+		a.MailId = int(mailId)
+		a.DraftId = 0
+		_, err = tx.Exec("insert into attachments values (null, ?, nullif(?, 0), nullif(?, 0), ?, ?, ?, ?)", a.ToPtrSlice()[1:]...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if draftId != 0 {
+		query = "update attachments set draft_id = null, mail_id = ?, user_id = ? where draft_id = ?"
+		_, err = tx.Exec(query, mailId, mail.UserId, draftId)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int(mailId), tx.Commit()
 }
 
 /*
@@ -277,7 +847,7 @@ func newMail(mail Mail) error {
 
 Load an array of mail from the database using a given query and argument list.
 */
-func loadMailArray[V Mail | Draft](query string, args []any) ([]V, error) {
+func loadMailArray[V Mail | InboxMail | ConvMail | TrashMail | Draft | SearchResult | Label | Block | DeliveryDay | Attachment | LetterTemplate | DraftRevision | Contact | SuggestedContact | Sender | DirectoryEntry | Language | MonthCount | Correspondent | ReplyTime | DueReminder](query string, args []any) ([]V, error) {
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
@@ -290,7 +860,7 @@ func loadMailArray[V Mail | Draft](query string, args []any) ([]V, error) {
 	// `Next` must be called even before first row, sets cursor and
 	// returns False if none OR if an error occurred
 	for rows.Next() {
-		// the dynamic value of any(&result) is either *Mail or *Draft
+		// the dynamic value of any(&result) is a pointer to one of the types in V
 		ptr := any(&result).(DbRowPtr)
 		// `Scan` copies data from rows to destination
 		err = rows.Scan(ptr.ToPtrSlice()...)
@@ -310,53 +880,193 @@ func loadMailArray[V Mail | Draft](query string, args []any) ([]V, error) {
 }
 
 /*
-	loadInbox: load all mail for a user's inbox
+	loadPage
 
-Params:
-- user: Slow Mail user id
-- date: date to match mail on
+Load a page of mailPerPage rows from a query, without loading the rows before it. The rows are
+ordered by the key columns `keyCols`, newest first, which must identify a row and be columns
+of the query's result. The query must not order or limit its own rows. `keyOf` gives the key
+of a row, in the same order as `keyCols`.
 
-loadInbox only returns the most recent mail per sender.
+If the cursor is past the end of the rows, or its key is invalid, the first page is loaded,
+just as parsePages does.
 */
-func loadInbox(user int, date int64) ([]Mail, error) {
-	query := `
+func loadPage[V Mail | InboxMail | ConvMail | Draft | DirectoryEntry](query string, args []any, keyCols []string, keyOf func(V) []any,
+	cursor PageCursor) (Page[V], error) {
+	var page Page[V]
+	if cursor.Key != nil && len(cursor.Key) != len(keyCols) {
+		cursor = PageCursor{}
+	}
+
+	cols := "(" + strings.Join(keyCols, ", ") + ")"
+	params := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(keyCols)), ", ") + ")"
+	order := strings.Join(keyCols, " desc, ") + " desc"
+	pageArgs := slices.Clone(args)
+	var where string
+	if cursor.Key != nil {
+		where = "where " + cols + " < " + params
+		if cursor.Back {
+			// walk back from the key, and put the rows in order afterwards
+			where = "where " + cols + " > " + params
+			order = strings.Join(keyCols, " asc, ") + " asc"
+		}
+		pageArgs = append(pageArgs, cursor.Key...)
+	}
+
+	// one more row than fits on the page shows whether there are more
+	pageQuery := fmt.Sprintf("select * from (%s) %s order by %s limit ? offset ?", query, where, order)
+	pageArgs = append(pageArgs, mailPerPage+1, cursor.Offset)
+
+	rows, err := loadMailArray[V](pageQuery, pageArgs)
+	if err != nil {
+		return page, err
+	}
+	if len(rows) == 0 {
+		if cursor.Key != nil || cursor.Offset > 0 {
+			return loadPage(query, args, keyCols, keyOf, PageCursor{})
+		}
+		return page, nil
+	}
+
+	more := len(rows) > mailPerPage
+	if more {
+		rows = rows[:mailPerPage]
+	}
+	if cursor.Back {
+		slices.Reverse(rows)
+	}
+	page.Rows = rows
+	first, last := keyOf(rows[0]), keyOf(rows[len(rows)-1])
+
+	hasPrev, hasNext := cursor.Offset > 0, more
+	if cursor.Back {
+		hasPrev = more
+		hasNext, err = hasRowsBeyond(query, args, cols, params, "<", last)
+	} else if cursor.Key != nil {
+		hasPrev, err = hasRowsBeyond(query, args, cols, params, ">", first)
+	}
+	if hasPrev {
+		page.PrevKey = first
+	}
+	if hasNext {
+		page.NextKey = last
+	}
+	return page, err
+}
+
+/* hasRowsBeyond: whether a query for loadPage has rows with keys beyond a key, compared with `op` */
+func hasRowsBeyond(query string, args []any, cols string, params string, op string, key []any) (bool, error) {
+	countQuery := fmt.Sprintf("select count(*) from (select 1 from (%s) where %s %s %s limit 1)", query, cols, op, params)
+
+	var count Count
+	err := loadSingleRow(countQuery, append(slices.Clone(args), key...), &count)
+	return count.N > 0, err
+}
+
+/* mailKey: the key of mail paged by loadPage, ordered by sending date */
+func mailKey(m Mail) []any {
+	return []any{m.OrigDate, m.MailId}
+}
+
+var mailKeyCols = []string{"orig_date", "mail_id"}
+
+/*
+	loadInbox: load a page of mail for a user's inbox
+
+Params:
+- user: Slow Mail user id
+- date: date to match mail on
+- cursor: the page to load
+
+loadInbox only returns the most recent mail per sender. If any of a sender's mail for
+the day has been archived, the whole conversation is left out of the inbox.
+Each mail also counts the earlier mail from the same sender that day, unless superseded
+mail is dropped. Mail delivered again after a snooze only counts the mail first delivered on
+the same day as it. Mail in the trash or requests folders, or from blocked senders, is left out.
+Only the start of each mail's content is loaded, for its preview.
+*/
+func loadInbox(user int, date int64, cursor PageCursor) (Page[InboxMail], error) {
+	return loadDayMail(user, date, false, cursor)
+}
+
+/*
+	loadDay
+
+Load a page of the mail delivered to a user on a day, like loadInbox, but keeping the
+conversations the user archived, so that a past day shows everything delivered on it.
+*/
+func loadDay(user int, date int64, cursor PageCursor) (Page[InboxMail], error) {
+	return loadDayMail(user, date, true, cursor)
+}
+
+/* loadDayMail: the query of loadInbox and loadDay, which keeps archived conversations if `withArchived` is true */
+func loadDayMail(user int, date int64, withArchived bool, cursor PageCursor) (Page[InboxMail], error) {
+	query := `
         select mail_id, user_id, folder, read, orig_date, date,
             from_head, from_name, from_addr, to_head, message_id, in_reply_to,
-            subject, content, multifrom, multito
+            subject, substr(content, 1, ?) as content, multifrom, multito, plain_text,
+            case when ? then 0 else sendercount - 1 end
         from (
-            -- Inner SELECT: mail on given date, marking most recent mail per sender
-            select *, row_number() over(partition by from_addr order by orig_date desc) as rownum
+            -- Inner SELECT: mail on given date, marking most recent mail per sender,
+            -- and whether the user archived any of that sender's mail
+            select *, row_number() over(partition by from_addr order by orig_date desc) as rownum,
+                max(folder = 'archive') over(partition by from_addr) as archived,
+                count(*) over(partition by from_addr, date) as sendercount
             from mail
-            where user_id = ? and date = ?
+            where user_id = ? and ` + deliveryDate("mail") + ` = ? and folder in ('inbox', 'archive') and not ` + fromBlocked + `
         ) 
-        where folder = 'inbox' and rownum = 1;
+        where rownum = 1 and (? or not archived)
     `
 
-	return loadMailArray[Mail](query, []any{user, date})
+	keyOf := func(m InboxMail) []any { return mailKey(m.Mail) }
+	return loadPage(query, []any{previewLength, dropSuperseded, user, date, withArchived}, mailKeyCols, keyOf, cursor)
 }
 
 /*
-	loadArchive: load all mail for a user's archive
+	loadArchive: load a page of mail for a user's archive
 
 loadArchive returns all the most recent mail per sender, as long as the date
-is prior to the passed date.
+is prior to the passed date. Mail in the trash or requests folders, or from blocked senders,
+is left out. Only the start of each mail's content is loaded, for its preview.
 */
-func loadArchive(user int, date int64) ([]Mail, error) {
+func loadArchive(user int, date int64, cursor PageCursor) (Page[Mail], error) {
 	query := `
         select mail_id, user_id, folder, read, orig_date, date,
             from_head, from_name, from_addr, to_head, message_id, in_reply_to,
-            subject, content, multifrom, multito
+            subject, substr(content, 1, ?) as content, multifrom, multito, plain_text
+        from mail
+        where user_id = ? and ` + deliveryDate("mail") + ` <= ? and folder in ('inbox', 'archive') and not ` + fromBlocked + `
+            -- most recent mail per sender
+            and not exists (
+                select 1 from mail as later
+                where later.user_id = mail.user_id and later.from_addr = mail.from_addr and ` + deliveryDate("later") + ` <= ?
+                    and later.folder in ('inbox', 'archive')
+                    and (later.orig_date, later.mail_id) > (mail.orig_date, mail.mail_id)
+            )
+    `
+
+	return loadPage(query, []any{previewLength, user, date, date}, mailKeyCols, mailKey, cursor)
+}
+
+/*
+	loadSenders
+
+Load everyone who has delivered mail in a user's inbox or archive, by the name on their
+latest mail, most recent first. Senders who are blocked are left out.
+*/
+func loadSenders(userId int, date int64) ([]Sender, error) {
+	query := `
+        select from_addr, from_name
         from (
-            -- Inner SELECT: mail on given date, marking most recent mail per sender
-            select *, row_number() over(partition by from_addr order by orig_date desc) as rownum
+            select from_addr, from_name, orig_date,
+                row_number() over(partition by from_addr order by orig_date desc) as rownum
             from mail
-            where user_id = ? and date <= ?
-        ) 
+            where user_id = ? and ` + deliveryDate("mail") + ` <= ? and folder in ('inbox', 'archive') and not ` + fromBlocked + `
+        )
         where rownum = 1
-        order by orig_date desc;
+        order by orig_date desc
     `
 
-	return loadMailArray[Mail](query, []any{user, date})
+	return loadMailArray[Sender](query, []any{userId, date})
 }
 
 /*
@@ -365,7 +1075,7 @@ func loadArchive(user int, date int64) ([]Mail, error) {
 Insert a new draft
 */
 func newDraft(draft Draft) error {
-	query := "insert into drafts values (null, ?, ?, ?, ?)"
+	query := "insert into drafts values (null, ?, ?, ?, ?, ?)"
 
 	draftValues := draft.ToPtrSlice()[1:]
 	_, err := db.Exec(query, draftValues...)
@@ -385,13 +1095,53 @@ Update an existing draft
 func updateDraft(draft Draft) error {
 	query := `
         update drafts
-        set subject = ?, content = ?
+        set subject = ?, content = ?, plain_text = ?
         where user_id = ? and recipient = ?
     `
-	_, err := db.Exec(query, draft.Subject, draft.Content, draft.UserId, draft.Recipient)
+	_, err := db.Exec(query, draft.Subject, draft.Content, draft.PlainText, draft.UserId, draft.Recipient)
+	return err
+}
+
+/*
+	updateDraftById
+
+Update a draft by its id, including its recipient. If the user already has another draft
+to the new recipient, returns ErrNotUnique.
+*/
+func updateDraftById(draft Draft) error {
+	query := `
+        update drafts
+        set recipient = ?, subject = ?, content = ?, plain_text = ?
+        where draft_id = ? and user_id = ?
+    `
+	_, err := db.Exec(query, draft.Recipient, draft.Subject, draft.Content, draft.PlainText, draft.DraftId, draft.UserId)
+	sqliteErr, _ := err.(sqlite.Error)
+	if sqliteErr.ExtendedCode == sqlite.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite.ErrConstraintPrimaryKey {
+		return ErrNotUnique
+	}
 	return err
 }
 
+/*
+	loadDraftById
+
+Load one of a user's drafts by its id. Returns ErrNotFound if the user has no draft with that id.
+*/
+func loadDraftById(userId int, draftId string) (*Draft, error) {
+	query := `
+        select draft_id, user_id, recipient, subject, content, plain_text
+        from drafts
+        where draft_id = ? and user_id = ?
+    `
+
+	var draft Draft
+	err := loadSingleRow(query, []any{draftId, userId}, &draft)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &draft, err
+}
+
 /*
 	loadDraft
 
@@ -400,7 +1150,7 @@ in loadSingleRow.
 */
 func loadDraft(userId int, recipient string) (*Draft, error) {
 	query := `
-        select draft_id, user_id, recipient, subject, content
+        select draft_id, user_id, recipient, subject, content, plain_text
         from drafts
         where user_id = ? and recipient = ?
     `
@@ -413,27 +1163,62 @@ func loadDraft(userId int, recipient string) (*Draft, error) {
 	return &draft, err
 }
 
-/* loadAllDrafts: load all drafts */
-func loadAllDrafts(userId int) ([]Draft, error) {
+/* loadDrafts: load a page of drafts, newest first, with only the start of their content */
+func loadDrafts(userId int, cursor PageCursor) (Page[Draft], error) {
 	query := `
-		select draft_id, user_id, recipient, subject, content
+		select draft_id, user_id, recipient, subject, substr(content, 1, ?) as content, plain_text
 		from drafts
 		where user_id = ?
 	`
-	return loadMailArray[Draft](query, []any{userId})
+	keyOf := func(d Draft) []any { return []any{d.DraftId} }
+	return loadPage(query, []any{previewLength, userId}, []string{"draft_id"}, keyOf, cursor)
 }
 
 /*
 	deleteDraft
 
-Deletes draft between userId and recipient.
+Deletes draft between userId and recipient, and any attachments still on it.
 */
 func deleteDraft(userId int, recipient string) error {
-	query := "delete from drafts where user_id = ? and recipient = ?"
+	query := `
+        delete from attachments
+        where draft_id in (select draft_id from drafts where user_id = ? and recipient = ?)
+    `
 	_, err := db.Exec(query, userId, recipient)
+	if err != nil {
+		return err
+	}
+
+	query = `
+        delete from draft_revisions
+        where draft_id in (select draft_id from drafts where user_id = ? and recipient = ?)
+    `
+	_, err = db.Exec(query, userId, recipient)
+	if err != nil {
+		return err
+	}
+
+	query = "delete from drafts where user_id = ? and recipient = ?"
+	_, err = db.Exec(query, userId, recipient)
 	return err
 }
 
+/*
+	loadDeliveredMail
+
+Load one of a user's mail, if it was delivered by the passed date. Returns ErrNotFound otherwise.
+*/
+func loadDeliveredMail(userId int, mailId string, date int64) (*Mail, error) {
+	query := "select * from mail where mail_id = ? and user_id = ? and " + deliveryDate("mail") + " <= ?"
+
+	var mail Mail
+	err := loadSingleRow(query, []any{mailId, userId, date}, &mail)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &mail, err
+}
+
 /*
 	loadSenderAddr
 
@@ -448,20 +1233,1421 @@ func loadSenderAddr(mailId string) (Sender, error) {
 	return sender, err
 }
 
+// query for the mail in a conversation, for loadConv and loadWholeConv. Its parameters are
+// the user id, the sender's address, the date, and whether superseded mail is dropped.
+// A letter is superseded by a later one delivered on the same day, both first and after any
+// snooze, so that snoozing a conversation doesn't make its earlier letters superseded.
+var convQuery = `
+    select *
+    from (
+        select mail_id, user_id, folder, read, orig_date, date,
+            from_head, from_name, from_addr, to_head, message_id, in_reply_to,
+            subject, content, multifrom, multito, plain_text,
+            exists (
+                select 1 from mail as later
+                where later.user_id = mail.user_id and later.from_addr = mail.from_addr
+                    and later.date = mail.date and ` + deliveryDate("later") + ` = ` + deliveryDate("mail") + `
+                    and later.folder in ('inbox', 'archive')
+                    and (later.orig_date, later.mail_id) > (mail.orig_date, mail.mail_id)
+            ) as superseded
+        from mail
+        where user_id = ? and from_addr = ? and ` + deliveryDate("mail") + ` <= ? and folder in ('inbox', 'archive')
+            and not ` + fromBlocked + `
+    )
+    where not (superseded and ?)
+`
+
+/*
+	loadSender
+
+Load a sender by the address a user has mail from, named as on their latest mail. Returns
+ErrNotFound if the user has no mail from the address.
+*/
+func loadSender(userId int, senderAddr string) (Sender, error) {
+	query := `
+        select from_addr, coalesce(from_name, '')
+        from mail
+        where user_id = ? and from_addr = ?
+        order by orig_date desc
+        limit 1
+    `
+
+	var sender Sender
+	err := loadSingleRow(query, []any{userId, senderAddr}, &sender)
+	return sender, err
+}
+
 /*
 	loadConv
 
-Load array of mail corresponding to a conversation between the user and one sender.
+Load a page of mail in a conversation between the user and one sender, newest first.
+Mail is superseded if a later mail from the sender was delivered the same day; if superseded
+mail is dropped, it is left out. Mail in the trash or requests folders, or from blocked
+senders, is left out.
 */
-func loadConv(userId int, senderAddr string, date int64) ([]Mail, error) {
+func loadConv(userId int, senderAddr string, date int64, cursor PageCursor) (Page[ConvMail], error) {
+	keyOf := func(m ConvMail) []any { return mailKey(m.Mail) }
+	return loadPage(convQuery, []any{userId, senderAddr, date, dropSuperseded}, mailKeyCols, keyOf, cursor)
+}
+
+/*
+	loadWholeConv
+
+Load all of the mail in a conversation, oldest first. The mail is the same as in loadConv.
+*/
+func loadWholeConv(userId int, senderAddr string, date int64) ([]ConvMail, error) {
+	query := "select * from (" + convQuery + ") order by orig_date, mail_id"
+	return loadMailArray[ConvMail](query, []any{userId, senderAddr, date, dropSuperseded})
+}
+
+/*
+	convArchived
+
+Whether a conversation is archived, which it is if its latest delivered mail is.
+*/
+func convArchived(userId int, senderAddr string, date int64) (bool, error) {
 	query := `
-        select mail_id, user_id, folder, read, orig_date, date,
-            from_head, from_name, from_addr, to_head, message_id, in_reply_to,
-            subject, content, multifrom, multito
+        select folder = 'archive'
         from mail
-        where user_id = ? and from_addr = ? and date <= ?
-        order by orig_date desc;
+        where user_id = ? and from_addr = ? and ` + deliveryDate("mail") + ` <= ? and folder in ('inbox', 'archive')
+        order by orig_date desc
+        limit 1
+    `
+
+	var archived Count
+	err := loadSingleRow(query, []any{userId, senderAddr, date}, &archived)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return archived.N == 1, err
+}
+
+/*
+	updateConvFolder
+
+Move all delivered mail from one sender into a folder ('inbox' or 'archive').
+Mail with a later delivery date than `date`, including snoozed mail, is left alone,
+so it still arrives in the inbox when it is delivered.
+*/
+func updateConvFolder(userId int, senderAddr string, folder string, date int64) error {
+	query := `
+        update mail
+        set folder = ?
+        where user_id = ? and from_addr = ? and ` + deliveryDate("mail") + ` <= ? and folder in ('inbox', 'archive')
+    `
+	_, err := db.Exec(query, folder, userId, senderAddr, date)
+	return err
+}
+
+/*
+	snoozeMail
+
+Snooze delivered mail to a later day, when it is delivered again. The mail matches `cond`,
+a condition on the mail table with the parameters `args`. Snoozed mail goes back to the inbox
+as unread, so that it arrives like new mail. Its original delivery date is kept.
+*/
+func snoozeMail(userId int, cond string, args []any, until int64, date int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	where := "user_id = ? and " + deliveryDate("mail") + " <= ? and folder in ('inbox', 'archive') and " + cond
+	whereArgs := append([]any{userId, date}, args...)
+
+	_, err = tx.Exec("update mail set folder = 'inbox', read = 0 where "+where, whereArgs...)
+	if err != nil {
+		return err
+	}
+	query := `
+        insert into snoozes (mail_id, until)
+        select mail_id, ? from mail where ` + where + `
+        on conflict (mail_id) do update set until = excluded.until
+    `
+	_, err = tx.Exec(query, append([]any{until}, whereArgs...)...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/* snoozePiece: snooze one delivered mail to a later day */
+func snoozePiece(userId int, mailId string, until int64, date int64) error {
+	return snoozeMail(userId, "mail_id = ?", []any{mailId}, until, date)
+}
+
+/* snoozeConv: snooze all delivered mail from one sender to a later day */
+func snoozeConv(userId int, senderAddr string, until int64, date int64) error {
+	return snoozeMail(userId, "from_addr = ?", []any{senderAddr}, until, date)
+}
+
+/*
+	markConvRead
+
+Mark all delivered mail from one sender as read.
+*/
+func markConvRead(userId int, senderAddr string, date int64) error {
+	query := `
+        update mail
+        set read = 1
+        where user_id = ? and from_addr = ? and ` + deliveryDate("mail") + ` <= ? and folder in ('inbox', 'archive')
+    `
+	_, err := db.Exec(query, userId, senderAddr, date)
+	return err
+}
+
+/*
+	markConvUnread
+
+Mark the latest delivered mail from one sender as unread. Mailboxes show the read
+status of the latest mail, so this is enough to show the conversation as unread.
+*/
+func markConvUnread(userId int, senderAddr string, date int64) error {
+	query := `
+        update mail
+        set read = 0
+        where mail_id = (
+            select mail_id
+            from mail
+            where user_id = ? and from_addr = ? and ` + deliveryDate("mail") + ` <= ? and folder in ('inbox', 'archive')
+            order by orig_date desc
+            limit 1
+        )
+    `
+	_, err := db.Exec(query, userId, senderAddr, date)
+	return err
+}
+
+/*
+	markInboxRead
+
+Mark all mail in a day's inbox as read.
+*/
+func markInboxRead(userId int, date int64) error {
+	query := `
+        update mail
+        set read = 1
+        where user_id = ? and ` + deliveryDate("mail") + ` = ? and folder = 'inbox'
+    `
+	_, err := db.Exec(query, userId, date)
+	return err
+}
+
+/*
+	countUnread
+
+Count the conversations in a day's inbox whose latest mail is unread. Conversations are
+chosen the same way as in loadInbox.
+*/
+func countUnread(userId int, date int64) (int, error) {
+	query := `
+        select count(*)
+        from (
+            select read, row_number() over(partition by from_addr order by orig_date desc) as rownum,
+                max(folder = 'archive') over(partition by from_addr) as archived
+            from mail
+            where user_id = ? and ` + deliveryDate("mail") + ` = ? and folder in ('inbox', 'archive') and not ` + fromBlocked + `
+        )
+        where rownum = 1 and not archived and not read;
     `
 
-	return loadMailArray[Mail](query, []any{userId, senderAddr, date})
+	var count Count
+	err := loadSingleRow(query, []any{userId, date}, &count)
+	return count.N, err
+}
+
+/*
+	searchMail
+
+Search a user's delivered mail with the full-text index, best matches first.
+
+Params:
+- userId: Slow Mail user id
+- terms: FTS5 query string (see ftsQuery)
+- senderAddr: only match mail from this address, unless empty
+- after, before: only match mail delivered in this range of dates, inclusive
+
+Snippets mark the matching text with the control characters \x02 and \x03, rather than
+HTML, so that the caller can escape the snippet before highlighting it.
+*/
+func searchMail(userId int, terms string, senderAddr string, after int64, before int64) ([]SearchResult, error) {
+	query := `
+        select mail.mail_id, mail.from_name, mail.from_addr, mail.subject, ` + deliveryDate("mail") + `,
+            snippet(mail_fts, -1, char(2), char(3), '...', 16)
+        from mail_fts join mail on mail.mail_id = mail_fts.rowid
+        where mail_fts match ? and mail.user_id = ? and mail.folder in ('inbox', 'archive')
+            and not ` + fromBlocked + `
+            and (? = '' or mail.from_addr = ?)
+            and ` + deliveryDate("mail") + ` >= ? and ` + deliveryDate("mail") + ` <= ?
+        order by rank;
+    `
+
+	return loadMailArray[SearchResult](query, []any{terms, userId, senderAddr, senderAddr, after, before})
+}
+
+/*
+	newLabel
+
+Insert a new label. If the user already has a label with that name, returns ErrNotUnique.
+*/
+func newLabel(label Label) error {
+	query := "insert into labels values (null, ?, ?)"
+	_, err := db.Exec(query, label.UserId, label.Name)
+	sqliteErr, _ := err.(sqlite.Error)
+	if sqliteErr.ExtendedCode == sqlite.ErrConstraintUnique {
+		return ErrNotUnique
+	}
+	return err
+}
+
+/*
+	renameLabel
+
+Update the name of a label. If the user already has a label with that name, returns ErrNotUnique.
+*/
+func renameLabel(label Label) error {
+	query := "update labels set name = ? where label_id = ? and user_id = ?"
+	_, err := db.Exec(query, label.Name, label.LabelId, label.UserId)
+	sqliteErr, _ := err.(sqlite.Error)
+	if sqliteErr.ExtendedCode == sqlite.ErrConstraintUnique {
+		return ErrNotUnique
+	}
+	return err
+}
+
+/*
+	deleteLabel
+
+Delete a label and remove it from all conversations.
+*/
+func deleteLabel(userId int, labelId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	_, err = tx.Exec("delete from conv_labels where label_id = ? and user_id = ?", labelId, userId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from labels where label_id = ? and user_id = ?", labelId, userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+	loadLabel
+
+Load one of a user's labels. Returns ErrNotFound if the user has no label with that id.
+*/
+func loadLabel(userId int, labelId string) (*Label, error) {
+	query := "select label_id, user_id, name from labels where label_id = ? and user_id = ?"
+
+	var label Label
+	err := loadSingleRow(query, []any{labelId, userId}, &label)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &label, err
+}
+
+/* loadLabels: load all of a user's labels, by name */
+func loadLabels(userId int) ([]Label, error) {
+	query := "select label_id, user_id, name from labels where user_id = ? order by name"
+	return loadMailArray[Label](query, []any{userId})
+}
+
+/* loadConvLabels: load the labels on the conversation with a sender */
+func loadConvLabels(userId int, senderAddr string) ([]Label, error) {
+	query := `
+        select labels.label_id, labels.user_id, name
+        from labels join conv_labels
+            on labels.label_id = conv_labels.label_id
+        where conv_labels.user_id = ? and sender_addr = ?
+        order by name
+    `
+	return loadMailArray[Label](query, []any{userId, senderAddr})
+}
+
+/*
+	updateConvLabels
+
+Replace the labels on the conversation with a sender. Label ids that don't belong to
+the user are ignored.
+*/
+func updateConvLabels(userId int, senderAddr string, labelIds []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	_, err = tx.Exec("delete from conv_labels where user_id = ? and sender_addr = ?", userId, senderAddr)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        insert or ignore into conv_labels
+        select label_id, user_id, ?
+        from labels
+        where label_id = ? and user_id = ?
+    `
+	for _, labelId := range labelIds {
+		_, err = tx.Exec(query, senderAddr, labelId, userId)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+	loadLabelFolder
+
+Load the mail for a label's folder. Like loadArchive, this is the most recent mail per
+sender delivered by the passed date, but only for senders with the label.
+*/
+func loadLabelFolder(userId int, labelId int, date int64) ([]Mail, error) {
+	query := `
+        select mail_id, user_id, folder, read, orig_date, date,
+            from_head, from_name, from_addr, to_head, message_id, in_reply_to,
+            subject, content, multifrom, multito, plain_text
+        from (
+            -- Inner SELECT: labeled mail by given date, marking most recent mail per sender
+            select *, row_number() over(partition by from_addr order by orig_date desc) as rownum
+            from mail
+            where user_id = ? and ` + deliveryDate("mail") + ` <= ? and folder in ('inbox', 'archive') and not ` + fromBlocked + `
+                and from_addr in (
+                select sender_addr from conv_labels where label_id = ? and user_id = ?
+            )
+        )
+        where rownum = 1
+        order by orig_date desc;
+    `
+
+	return loadMailArray[Mail](query, []any{userId, date, labelId, userId})
+}
+
+/*
+	trashMail
+
+Move mail to the trash, recording its folder so that it can be restored. `cond` is an
+SQL condition on the mail table that chooses which of the user's mail to trash, and
+`args` are its arguments. Only mail delivered by `date` is trashed.
+*/
+func trashMail(userId int, date int64, cond string, args ...any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	where := "where user_id = ? and " + deliveryDate("mail") + " <= ? and folder in ('inbox', 'archive') and " + cond
+	whereArgs := append([]any{userId, date}, args...)
+
+	query := "insert into trash select mail_id, user_id, folder, ? from mail " + where
+	_, err = tx.Exec(query, append([]any{time.Now().Unix()}, whereArgs...)...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("update mail set folder = 'trash' "+where, whereArgs...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/* trashPiece: move a single delivered mail to the trash */
+func trashPiece(userId int, mailId string, date int64) error {
+	return trashMail(userId, date, "mail_id = ?", mailId)
+}
+
+/* trashConv: move all delivered mail from a sender to the trash */
+func trashConv(userId int, senderAddr string, date int64) error {
+	return trashMail(userId, date, "from_addr = ?", senderAddr)
+}
+
+/*
+	restoreMail
+
+Move mail out of the trash, back to the folder it was in. `cond` is an SQL condition on
+the mail table that chooses which of the user's trashed mail to restore, and `args` are
+its arguments.
+*/
+func restoreMail(userId int, cond string, args ...any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	where := "where user_id = ? and folder = 'trash' and " + cond
+	whereArgs := append([]any{userId}, args...)
+
+	query := `
+        update mail
+        set folder = (select prev_folder from trash where trash.mail_id = mail.mail_id)
+    ` + where
+	_, err = tx.Exec(query, whereArgs...)
+	if err != nil {
+		return err
+	}
+	// restored mail is no longer in the trash folder
+	_, err = tx.Exec("delete from trash where user_id = ? and mail_id in (select mail_id from mail where user_id = ? and folder != 'trash')",
+		userId, userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/* restorePiece: restore a single mail from the trash */
+func restorePiece(userId int, mailId string) error {
+	return restoreMail(userId, "mail_id = ?", mailId)
+}
+
+/* restoreConv: restore all trashed mail from a sender */
+func restoreConv(userId int, senderAddr string) error {
+	return restoreMail(userId, "from_addr = ?", senderAddr)
+}
+
+/* loadTrash: load a user's trashed mail, most recently trashed first */
+func loadTrash(userId int) ([]TrashMail, error) {
+	query := `
+        select mail.mail_id, mail.user_id, folder, read, orig_date, date,
+            from_head, from_name, from_addr, to_head, message_id, in_reply_to,
+            subject, content, multifrom, multito, plain_text, trash_date
+        from mail join trash
+            on mail.mail_id = trash.mail_id
+        where mail.user_id = ?
+        order by trash_date desc, orig_date desc;
+    `
+
+	return loadMailArray[TrashMail](query, []any{userId})
+}
+
+/*
+	purgeMail
+
+Permanently delete trashed mail, with its attachments and search index entries. `cond` is an SQL condition
+on the trash table that chooses which mail to delete, and `args` are its arguments.
+*/
+func purgeMail(cond string, args ...any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	trashed := "(select mail_id from trash where " + cond + ")"
+	_, err = tx.Exec("delete from mail_fts where rowid in "+trashed, args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from attachments where mail_id in "+trashed, args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from snoozes where mail_id in "+trashed, args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from dismissed_nudges where mail_id in "+trashed, args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from mail where mail_id in "+trashed, args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from trash where "+cond, args...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/* emptyTrash: permanently delete all of a user's trashed mail */
+func emptyTrash(userId int) error {
+	return purgeMail("user_id = ?", userId)
+}
+
+/* purgeTrash: permanently delete all users' mail that was trashed before the given time */
+func purgeTrash(before int64) error {
+	return purgeMail("trash_date < ?", before)
+}
+
+/*
+	newBlock
+
+Block an address or a domain for a user. Blocking something twice has no effect.
+*/
+func newBlock(block Block) error {
+	query := "insert or ignore into blocks values (?, ?)"
+	_, err := db.Exec(query, block.UserId, strings.ToLower(block.Blocked))
+	return err
+}
+
+/* deleteBlock: unblock an address or domain */
+func deleteBlock(block Block) error {
+	query := "delete from blocks where user_id = ? and blocked = ?"
+	_, err := db.Exec(query, block.UserId, block.Blocked)
+	return err
+}
+
+/* loadBlocks: load all addresses and domains a user blocked */
+func loadBlocks(userId int) ([]Block, error) {
+	query := "select user_id, blocked from blocks where user_id = ? order by blocked"
+	return loadMailArray[Block](query, []any{userId})
+}
+
+/*
+	isBlocked
+
+Checks if a user blocked an address, either directly or by its domain.
+*/
+func isBlocked(userId int, addr string) (bool, error) {
+	_, domain, _ := strings.Cut(addr, "@")
+	query := "select count(*) from blocks where user_id = ? and blocked in (?, ?)"
+
+	var count Count
+	err := loadSingleRow(query, []any{userId, strings.ToLower(addr), strings.ToLower(domain)}, &count)
+	return count.N > 0, err
+}
+
+/*
+	loadPreferences
+
+Load a user's preferences. Users who never saved preferences get the defaults.
+*/
+func loadPreferences(userId int) (Preferences, error) {
+	query := "select user_id, contacts_only, nudge_days, time_zone from preferences where user_id = ?"
+
+	prefs := Preferences{UserId: userId}
+	err := loadSingleRow(query, []any{userId}, &prefs)
+	if err == ErrNotFound {
+		return prefs, nil
+	}
+	return prefs, err
+}
+
+/* updatePreferences: save a user's preferences */
+func updatePreferences(prefs Preferences) error {
+	query := `
+        insert into preferences values (?, ?, ?, ?)
+        on conflict (user_id) do update set contacts_only = excluded.contacts_only, nudge_days = excluded.nudge_days,
+            time_zone = excluded.time_zone
+    `
+	_, err := db.Exec(query, prefs.ToPtrSlice()...)
+	return err
+}
+
+/*
+	isKnownSender
+
+Checks if a user knows a sender: the sender is in the user's contacts, the user has received
+mail from the sender outside of the requests folder, or the user has written to the sender.
+Addresses are compared ignoring case.
+
+Params:
+- userId, userAddr: id and address of the user receiving mail
+- senderId, senderAddr: id and address of the sender, who is also a Slow Mail user
+*/
+func isKnownSender(userId int, userAddr string, senderId int, senderAddr string) (bool, error) {
+	query := `
+        select (
+            select count(*)
+            from mail
+            where (user_id = ? and lower(from_addr) = lower(?) and folder != 'requests')
+                or (user_id = ? and lower(from_addr) = lower(?))
+        ) + (
+            select count(*) from contacts where user_id = ? and addr = lower(?)
+        )
+    `
+
+	var count Count
+	err := loadSingleRow(query, []any{userId, senderAddr, senderId, userAddr, userId, senderAddr}, &count)
+	return count.N > 0, err
+}
+
+/*
+	loadRequests
+
+Load mail held in the requests folder, delivered by the passed date. Like loadArchive,
+only the most recent mail per sender is returned, and each counts the sender's other
+held mail. Held mail can't be snoozed, so it is matched on its own date.
+*/
+func loadRequests(userId int, date int64) ([]InboxMail, error) {
+	query := `
+        select mail_id, user_id, folder, read, orig_date, date,
+            from_head, from_name, from_addr, to_head, message_id, in_reply_to,
+            subject, content, multifrom, multito, plain_text, sendercount - 1
+        from (
+            -- Inner SELECT: held mail by given date, marking most recent mail per sender
+            select *, row_number() over(partition by from_addr order by orig_date desc) as rownum,
+                count(*) over(partition by from_addr) as sendercount
+            from mail
+            where user_id = ? and date <= ? and folder = 'requests' and not ` + fromBlocked + `
+        )
+        where rownum = 1
+        order by orig_date desc;
+    `
+
+	return loadMailArray[InboxMail](query, []any{userId, date})
+}
+
+/* countRequests: count senders with mail in the requests folder, delivered by the passed date */
+func countRequests(userId int, date int64) (int, error) {
+	query := `
+        select count(distinct from_addr)
+        from mail
+        where user_id = ? and date <= ? and folder = 'requests' and not ` + fromBlocked + `
+    `
+
+	var count Count
+	err := loadSingleRow(query, []any{userId, date}, &count)
+	return count.N, err
+}
+
+/*
+	acceptRequest
+
+Move all of a sender's held mail to the inbox, where it is delivered like any other mail.
+*/
+func acceptRequest(userId int, senderAddr string) error {
+	query := `
+        update mail
+        set folder = 'inbox'
+        where user_id = ? and from_addr = ? and folder = 'requests'
+    `
+	_, err := db.Exec(query, userId, senderAddr)
+	return err
+}
+
+/*
+	declineRequest
+
+Permanently delete all of a sender's held mail, with its attachments and search index entries.
+*/
+func declineRequest(userId int, senderAddr string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	held := "(select mail_id from mail where user_id = ? and from_addr = ? and folder = 'requests')"
+	_, err = tx.Exec("delete from mail_fts where rowid in "+held, userId, senderAddr)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from attachments where mail_id in "+held, userId, senderAddr)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from snoozes where mail_id in "+held, userId, senderAddr)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from dismissed_nudges where mail_id in "+held, userId, senderAddr)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from mail where mail_id in "+held, userId, senderAddr)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+	loadDeliveryDays
+
+Load the days in a range when a user received mail, from `start` up to but not including
+`end`. Mail that wouldn't be shown in the inbox or archive isn't counted.
+*/
+func loadDeliveryDays(userId int, start int64, end int64) ([]DeliveryDay, error) {
+	query := `
+        select distinct ` + deliveryDate("mail") + ` as day
+        from mail
+        where user_id = ? and day >= ? and day < ? and folder in ('inbox', 'archive') and not ` + fromBlocked + `
+        order by day
+    `
+	return loadMailArray[DeliveryDay](query, []any{userId, start, end})
+}
+
+/*
+	newAttachment
+
+Save an attachment to a mail or a draft. Set the id of the other one to 0.
+*/
+func newAttachment(attachment Attachment) error {
+	query := "insert into attachments values (null, ?, nullif(?, 0), nullif(?, 0), ?, ?, ?, ?)"
+	_, err := db.Exec(query, attachment.ToPtrSlice()[1:]...)
+	return err
+}
+
+/*
+	loadAttachmentList
+
+Load the attachments on a mail or a draft, without their data. Set the id of the other one to 0.
+*/
+func loadAttachmentList(mailId int, draftId int) ([]Attachment, error) {
+	query := `
+        select attachment_id, user_id, coalesce(mail_id, 0), coalesce(draft_id, 0), filename, mime_type, size,
+            x'' -- data isn't needed to list attachments
+        from attachments
+        where mail_id = ? or draft_id = ?
+        order by attachment_id
+    `
+	return loadMailArray[Attachment](query, []any{mailId, draftId})
+}
+
+/*
+	loadAttachment
+
+Load an attachment with its data. Returns ErrNotFound unless the user owns the attachment,
+and it is on a draft or on mail delivered by the passed date.
+*/
+func loadAttachment(userId int, attachmentId string, date int64) (*Attachment, error) {
+	query := `
+        select attachment_id, attachments.user_id, coalesce(attachments.mail_id, 0), coalesce(draft_id, 0),
+            filename, mime_type, size, data
+        from attachments left join mail
+            on attachments.mail_id = mail.mail_id
+        where attachment_id = ? and attachments.user_id = ? and (mail.mail_id is null or ` + deliveryDate("mail") + ` <= ?)
+    `
+
+	var attachment Attachment
+	err := loadSingleRow(query, []any{attachmentId, userId, date}, &attachment)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &attachment, err
+}
+
+/* loadAttachmentUsage: total size of all attachments a user owns */
+func loadAttachmentUsage(userId int) (int64, error) {
+	query := "select coalesce(sum(size), 0) from attachments where user_id = ?"
+
+	var count Count
+	err := loadSingleRow(query, []any{userId}, &count)
+	return int64(count.N), err
+}
+
+/* sumAttachments: total size of the attachments on a mail or a draft. Set the id of the other one to 0. */
+func sumAttachments(mailId int, draftId int) (int64, error) {
+	query := "select coalesce(sum(size), 0) from attachments where mail_id = ? or draft_id = ?"
+
+	var count Count
+	err := loadSingleRow(query, []any{mailId, draftId}, &count)
+	return int64(count.N), err
+}
+
+/*
+	newTemplate
+
+Insert a new signature or letter template. If the user already has one of the same kind
+with that name, returns ErrNotUnique.
+*/
+func newTemplate(letterTemplate LetterTemplate) error {
+	query := "insert into letter_templates values (null, ?, ?, ?, ?)"
+	_, err := db.Exec(query, letterTemplate.ToPtrSlice()[1:]...)
+	sqliteErr, _ := err.(sqlite.Error)
+	if sqliteErr.ExtendedCode == sqlite.ErrConstraintUnique {
+		return ErrNotUnique
+	}
+	return err
+}
+
+/*
+	updateTemplate
+
+Update the name and content of a signature or letter template. If the user already has one
+of the same kind with that name, returns ErrNotUnique.
+*/
+func updateTemplate(letterTemplate LetterTemplate) error {
+	query := "update letter_templates set name = ?, content = ? where template_id = ? and user_id = ?"
+	_, err := db.Exec(query, letterTemplate.Name, letterTemplate.Content, letterTemplate.TemplateId, letterTemplate.UserId)
+	sqliteErr, _ := err.(sqlite.Error)
+	if sqliteErr.ExtendedCode == sqlite.ErrConstraintUnique {
+		return ErrNotUnique
+	}
+	return err
+}
+
+/* deleteTemplate: delete a signature or letter template */
+func deleteTemplate(userId int, templateId int) error {
+	query := "delete from letter_templates where template_id = ? and user_id = ?"
+	_, err := db.Exec(query, templateId, userId)
+	return err
+}
+
+/*
+	loadTemplate
+
+Load one of a user's signatures or letter templates. Returns ErrNotFound if the user has
+none with that id.
+*/
+func loadTemplate(userId int, templateId string) (*LetterTemplate, error) {
+	query := "select template_id, user_id, kind, name, content from letter_templates where template_id = ? and user_id = ?"
+
+	var letterTemplate LetterTemplate
+	err := loadSingleRow(query, []any{templateId, userId}, &letterTemplate)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &letterTemplate, err
+}
+
+/* loadTemplates: load a user's signatures and letter templates, signatures first */
+func loadTemplates(userId int) ([]LetterTemplate, error) {
+	query := `
+        select template_id, user_id, kind, name, content
+        from letter_templates
+        where user_id = ?
+        order by kind, name
+    `
+	return loadMailArray[LetterTemplate](query, []any{userId})
+}
+
+/*
+	loadContactName
+
+Load the display name a user last received mail from an address with. Returns ErrNotFound
+if they have no mail from that address.
+*/
+func loadContactName(userId int, addr string) (string, error) {
+	query := `
+        select from_addr, coalesce(from_name, '')
+        from mail
+        where user_id = ? and from_addr = ?
+        order by orig_date desc
+        limit 1
+    `
+
+	var sender Sender
+	err := loadSingleRow(query, []any{userId, addr}, &sender)
+	return sender.SenderName, err
+}
+
+/*
+	reviseDraft
+
+Record the current version of a draft as a revision, before it is overwritten. Nothing is
+recorded if it is the same as the latest revision, or if the latest revision is newer than
+`interval` seconds. Only the newest draftRevisionLimit revisions are kept.
+*/
+func reviseDraft(userId int, draftId int, interval int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// no effect once committed
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	query := `
+        insert into draft_revisions
+        select null, draft_id, user_id, ?, subject, content
+        from drafts
+        where draft_id = ? and user_id = ? and not exists (
+            select 1 from draft_revisions as r
+            where r.draft_id = drafts.draft_id and (r.date > ? or (
+                r.revision_id = (select max(revision_id) from draft_revisions where draft_id = drafts.draft_id)
+                and r.subject is drafts.subject and r.content is drafts.content))
+        )
+    `
+	_, err = tx.Exec(query, now, draftId, userId, now-interval)
+	if err != nil {
+		return err
+	}
+
+	query = `
+        delete from draft_revisions
+        where draft_id = ? and revision_id not in (
+            select revision_id from draft_revisions where draft_id = ? order by revision_id desc limit ?
+        )
+    `
+	_, err = tx.Exec(query, draftId, draftId, draftRevisionLimit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/* loadRevisions: load the earlier revisions of a draft, newest first */
+func loadRevisions(userId int, draftId int) ([]DraftRevision, error) {
+	query := `
+        select revision_id, draft_id, user_id, date, coalesce(subject, ''), coalesce(content, '')
+        from draft_revisions
+        where draft_id = ? and user_id = ?
+        order by revision_id desc
+    `
+	return loadMailArray[DraftRevision](query, []any{draftId, userId})
+}
+
+/*
+	loadRevision
+
+Load a revision of one of a user's drafts. Returns ErrNotFound if the draft has no
+revision with that id.
+*/
+func loadRevision(userId int, draftId int, revisionId string) (*DraftRevision, error) {
+	query := `
+        select revision_id, draft_id, user_id, date, coalesce(subject, ''), coalesce(content, '')
+        from draft_revisions
+        where revision_id = ? and draft_id = ? and user_id = ?
+    `
+
+	var revision DraftRevision
+	err := loadSingleRow(query, []any{revisionId, draftId, userId}, &revision)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &revision, err
+}
+
+/*
+	newContact
+
+Insert a new contact. The address is stored in lower case. If the user already has a contact
+with that address, returns ErrNotUnique.
+*/
+func newContact(contact Contact) error {
+	query := "insert into contacts values (null, ?, lower(?), ?, ?)"
+	_, err := db.Exec(query, contact.ToPtrSlice()[1:]...)
+	sqliteErr, _ := err.(sqlite.Error)
+	if sqliteErr.ExtendedCode == sqlite.ErrConstraintUnique {
+		return ErrNotUnique
+	}
+	return err
+}
+
+/*
+	updateContact
+
+Update a contact's address, nickname and notes. If the user already has another contact
+with the address, returns ErrNotUnique.
+*/
+func updateContact(contact Contact) error {
+	query := "update contacts set addr = lower(?), nickname = ?, notes = ? where contact_id = ? and user_id = ?"
+	_, err := db.Exec(query, contact.Addr, contact.Nickname, contact.Notes, contact.ContactId, contact.UserId)
+	sqliteErr, _ := err.(sqlite.Error)
+	if sqliteErr.ExtendedCode == sqlite.ErrConstraintUnique {
+		return ErrNotUnique
+	}
+	return err
+}
+
+/* deleteContact: delete a contact */
+func deleteContact(userId int, contactId int) error {
+	_, err := db.Exec("delete from contacts where contact_id = ? and user_id = ?", contactId, userId)
+	return err
+}
+
+/*
+	loadContact
+
+Load one of a user's contacts. Returns ErrNotFound if the user has no contact with that id.
+*/
+func loadContact(userId int, contactId string) (*Contact, error) {
+	query := "select contact_id, user_id, addr, nickname, notes from contacts where contact_id = ? and user_id = ?"
+
+	var contact Contact
+	err := loadSingleRow(query, []any{contactId, userId}, &contact)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &contact, err
+}
+
+/*
+	loadContactByAddr
+
+Load a user's contact for an address. Returns ErrNotFound if the address isn't in the
+user's contacts.
+*/
+func loadContactByAddr(userId int, addr string) (*Contact, error) {
+	query := "select contact_id, user_id, addr, nickname, notes from contacts where user_id = ? and addr = lower(?)"
+
+	var contact Contact
+	err := loadSingleRow(query, []any{userId, addr}, &contact)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &contact, err
+}
+
+/* loadContacts: load a user's contacts, by nickname and then address */
+func loadContacts(userId int) ([]Contact, error) {
+	query := `
+        select contact_id, user_id, addr, nickname, notes
+        from contacts
+        where user_id = ?
+        order by nickname = '', lower(nickname), addr
+    `
+	return loadMailArray[Contact](query, []any{userId})
+}
+
+/*
+	loadSuggestedContacts
+
+Load the addresses a user has received delivered mail from that aren't in their contacts,
+most frequent first. Mail in the requests folder and from blocked senders doesn't count.
+*/
+func loadSuggestedContacts(userId int, date int64, limit int) ([]SuggestedContact, error) {
+	query := `
+        select lower(from_addr), coalesce(max(from_name), ''), count(*) as n
+        from mail
+        where user_id = ? and ` + deliveryDate("mail") + ` <= ? and folder in ('inbox', 'archive') and not ` + fromBlocked + `
+            and lower(from_addr) not in (select addr from contacts where user_id = ?)
+        group by lower(from_addr)
+        order by n desc, lower(from_addr)
+        limit ?
+    `
+	return loadMailArray[SuggestedContact](query, []any{userId, date, userId, limit})
+}
+
+/*
+	loadAddressMatches
+
+Load addresses for the recipient autocomplete: contacts first, then other addresses the user
+has received delivered mail from. `prefix` matches the start of an address, or of a word in
+a nickname or name.
+*/
+func loadAddressMatches(userId int, prefix string, date int64, limit int) ([]Sender, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(prefix))
+	// ?1 user id, ?2 start of an address or name, ?3 start of a later word in a name, ?4 date, ?5 limit
+	query := `
+        select addr, name from (
+            select addr, nickname as name, 0 as rank
+            from contacts
+            where user_id = ?1 and (addr like ?2 escape '\' or lower(nickname) like ?2 escape '\'
+                or lower(nickname) like ?3 escape '\')
+            union all
+            select lower(from_addr), coalesce(max(from_name), ''), 1
+            from mail
+            where user_id = ?1 and ` + deliveryDate("mail") + ` <= ?4 and folder in ('inbox', 'archive') and not ` + fromBlocked + `
+                and lower(from_addr) not in (select addr from contacts where user_id = ?1)
+                and (lower(from_addr) like ?2 escape '\' or lower(from_name) like ?2 escape '\'
+                    or lower(from_name) like ?3 escape '\')
+            group by lower(from_addr)
+        )
+        order by rank, addr
+        limit ?5
+    `
+	return loadMailArray[Sender](query, []any{userId, pattern + "%", "% " + pattern + "%", date, limit})
+}
+
+/*
+	loadListing
+
+Load a user's listing in the pen-pal directory. Returns ErrNotFound if they aren't listed.
+*/
+func loadListing(userId int) (*Listing, error) {
+	query := "select user_id, bio, interests, language from directory where user_id = ?"
+
+	var listing Listing
+	err := loadSingleRow(query, []any{userId}, &listing)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &listing, err
+}
+
+/* updateListing: list a user in the pen-pal directory, or update their listing */
+func updateListing(listing Listing) error {
+	query := `
+        insert into directory values (?, ?, ?, ?)
+        on conflict (user_id) do update
+            set bio = excluded.bio, interests = excluded.interests, language = excluded.language
+    `
+	_, err := db.Exec(query, listing.ToPtrSlice()...)
+	return err
+}
+
+/* deleteListing: remove a user from the pen-pal directory */
+func deleteListing(userId int) error {
+	_, err := db.Exec("delete from directory where user_id = ?", userId)
+	return err
+}
+
+/*
+	loadDirectory
+
+Load a page of the listings in the pen-pal directory, other than the user's own, newest users
+first. `terms` matches words in the bio or interests, and `language` matches the language,
+ignoring case. Either can be empty to match every listing.
+*/
+func loadDirectory(userId int, terms string, language string, cursor PageCursor) (Page[DirectoryEntry], error) {
+	query := `
+        select directory.user_id, bio, interests, language, username, display_name
+        from directory join users
+            on directory.user_id = users.user_id
+        where directory.user_id != ? and (? = '' or lower(language) = lower(?))
+    `
+	args := []any{userId, language, language}
+	for _, word := range strings.Fields(strings.ToLower(terms)) {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(word) + "%"
+		query += ` and (lower(bio) like ? escape '\' or lower(interests) like ? escape '\')`
+		args = append(args, pattern, pattern)
+	}
+
+	keyOf := func(e DirectoryEntry) []any { return []any{e.UserId} }
+	return loadPage(query, args, []string{"user_id"}, keyOf, cursor)
+}
+
+/* loadDirectoryLanguages: the languages of the listings in the pen-pal directory */
+func loadDirectoryLanguages() ([]Language, error) {
+	query := "select distinct language from directory where language != '' order by lower(language)"
+	return loadMailArray[Language](query, nil)
+}
+
+/*
+	StatsRange
+
+The letters counted by the statistics queries: those a user received and sent in a range of
+days. Letters received count by their delivery date, once they are delivered, and letters
+sent count by the date they were written.
+*/
+type StatsRange struct {
+	UserId int
+	Addr   string // the user's address
+	Today  int64
+	After  int64 // inclusive
+	Before int64 // exclusive
+}
+
+/* args: the parameters of statsLetters, ?1 to ?5 */
+func (r StatsRange) args(more ...any) []any {
+	return append([]any{r.UserId, r.Addr, r.Today, r.After, r.Before}, more...)
+}
+
+// common table `letters` of the statistics queries. Each letter has the address of the
+// other person as `pal`, and `day`, the date it counts on.
+var statsLetters = `letters as (
+    -- letters received, leaving out held mail and bounces
+    select lower(from_addr) as pal, coalesce(from_name, '') as name, 0 as sent,
+        orig_date as written, ` + deliveryDate("mail") + ` as delivered, ` + deliveryDate("mail") + ` as day
+    from mail
+    where user_id = ?1 and lower(from_addr) != ?2 and folder in ('inbox', 'archive', 'trash')
+        and day <= ?3 and day >= ?4 and day < ?5
+    union all
+    -- letters the user wrote to other people
+    select recipient_addr, recipient_name, 1, orig_date, date, orig_date
+    from sent_letters
+    where user_id = ?1 and orig_date >= ?4 and orig_date < ?5
+)`
+
+/* newSentLetter: record a letter sent to another user, for the statistics page */
+func newSentLetter(sent SentLetter) error {
+	_, err := db.Exec("insert into sent_letters values (?, ?, ?, ?, ?)", sent.ToPtrSlice()...)
+	return err
+}
+
+/* loadMonthCounts: count the letters received and sent in each month, latest first */
+func loadMonthCounts(r StatsRange) ([]MonthCount, error) {
+	query := `
+        with ` + statsLetters + `
+        select strftime('%Y-%m', day, 'unixepoch', 'localtime') as month, sum(not sent), sum(sent)
+        from letters
+        group by month
+        order by month desc
+    `
+	return loadMailArray[MonthCount](query, r.args())
+}
+
+/* loadTopCorrespondents: load the people a user exchanged the most letters with */
+func loadTopCorrespondents(r StatsRange, limit int) ([]Correspondent, error) {
+	query := `
+        with ` + statsLetters + `
+        select pal, max(name), sum(not sent), sum(sent)
+        from letters
+        group by pal
+        order by count(*) desc, max(day) desc
+        limit ?6
+    `
+	return loadMailArray[Correspondent](query, r.args(limit))
+}
+
+/*
+	countNewCorrespondents
+
+Count the people whose first letter with the user, in either direction, is on or after `since`.
+*/
+func countNewCorrespondents(r StatsRange, since int64) (int, error) {
+	query := `
+        with ` + statsLetters + `
+        select count(*) from (
+            select pal from letters group by pal having min(day) >= ?6
+        )
+    `
+	var count Count
+	err := loadSingleRow(query, r.args(since), &count)
+	return count.N, err
+}
+
+/*
+	loadReplyTimes
+
+Load the average days taken to answer a letter: by the user, and by the people they write to.
+A letter answers the latest letter delivered from the other person before it was written,
+and only the first answer to each letter counts.
+*/
+func loadReplyTimes(r StatsRange) ([]ReplyTime, error) {
+	query := `
+        with ` + statsLetters + `,
+        answers as (
+            select reply.pal, reply.sent, reply.written, (
+                select max(letter.delivered) from letters as letter
+                where letter.pal = reply.pal and letter.sent != reply.sent and letter.delivered <= reply.written
+            ) as answered
+            from letters as reply
+        ),
+        first_answers as (
+            select sent, written - answered as wait,
+                row_number() over(partition by pal, sent, answered order by written) as rownum
+            from answers
+            where answered is not null
+        )
+        select sent, avg(wait) / 86400.0
+        from first_answers
+        where rownum = 1
+        group by sent
+    `
+	return loadMailArray[ReplyTime](query, r.args())
+}
+
+/*
+	loadLongestStreak
+
+Load the longest run of consecutive days on which the user received letters, or sent them
+if `sent` is true. The latest run wins a tie. Returns ErrNotFound if there are no letters.
+*/
+func loadLongestStreak(r StatsRange, sent bool) (Streak, error) {
+	query := `
+        with ` + statsLetters + `,
+        days as (
+            -- a date starts halfway through a Julian day, so each day has one whole number
+            select distinct cast(julianday(date(day, 'unixepoch', 'localtime')) as int) as daynum
+            from letters
+            where sent = ?6
+        ),
+        runs as (
+            -- days in a run are consecutive, so their difference from their rank is the same
+            select daynum, daynum - row_number() over(order by daynum) as run
+            from days
+        )
+        select count(*) as length, date(min(daynum) + 0.5), date(max(daynum) + 0.5)
+        from runs
+        group by run
+        order by length desc, max(daynum) desc
+        limit 1
+    `
+	var streak Streak
+	err := loadSingleRow(query, r.args(sent), &streak)
+	return streak, err
+}
+
+/* setReminder: set a reminder to reply to a conversation, replacing any earlier one */
+func setReminder(reminder Reminder) error {
+	query := `
+        insert into reminders values (?, ?, ?)
+        on conflict (user_id, sender_addr) do update set due = excluded.due
+    `
+	_, err := db.Exec(query, reminder.ToPtrSlice()...)
+	return err
+}
+
+/* loadReminder: load the reminder for a conversation. Returns ErrNotFound if there isn't one. */
+func loadReminder(userId int, senderAddr string) (*Reminder, error) {
+	query := "select user_id, sender_addr, due from reminders where user_id = ? and sender_addr = ?"
+
+	var reminder Reminder
+	err := loadSingleRow(query, []any{userId, senderAddr}, &reminder)
+	if err == ErrNotFound {
+		return nil, err
+	}
+	return &reminder, err
+}
+
+/* deleteReminder: delete the reminder for a conversation, if there is one */
+func deleteReminder(userId int, senderAddr string) error {
+	_, err := db.Exec("delete from reminders where user_id = ? and lower(sender_addr) = lower(?)", userId, senderAddr)
+	return err
+}
+
+/*
+	dismissNudge
+
+Stop showing a nudge about an unanswered letter. A later letter from the same sender can
+still be nudged about.
+*/
+func dismissNudge(userId int, mailId string) error {
+	query := `
+        insert or ignore into dismissed_nudges
+        select user_id, mail_id from mail where user_id = ? and mail_id = ?
+    `
+	_, err := db.Exec(query, userId, mailId)
+	return err
+}
+
+/*
+	loadDueReminders
+
+Load the conversations a user should reply to, most recent first: those with a reminder due
+by `date`, and if nudges are on, those whose latest letter was delivered by `nudgeDate`
+without the user writing back, as recorded in the user's sent letters.
+
+Params:
+- userAddr: the user's address
+- nudgeDays: the user's preference, 0 if nudges are off
+- nudgeDate: latest delivery date of a letter to nudge about
+*/
+func loadDueReminders(userId int, userAddr string, date int64, nudgeDays int, nudgeDate int64, limit int) ([]DueReminder, error) {
+	// ?1 user id, ?2 date, ?3 user's address, ?4 nudge days, ?5 nudge date, ?6 limit
+	query := `
+        with latest as (
+            -- latest delivered letter from each sender
+            select mail_id, from_addr, coalesce(from_name, '') as from_name, subject,
+                ` + deliveryDate("mail") + ` as delivered,
+                row_number() over(partition by from_addr order by orig_date desc) as rownum
+            from mail
+            where user_id = ?1 and ` + deliveryDate("mail") + ` <= ?2 and folder in ('inbox', 'archive')
+                and lower(from_addr) != ?3 and not ` + fromBlocked + `
+        )
+        select * from (
+            select latest.mail_id, latest.from_addr, latest.from_name, latest.subject, reminders.due as date, 0 as nudge
+            from reminders join latest on latest.from_addr = reminders.sender_addr
+            where reminders.user_id = ?1 and reminders.due <= ?2 and latest.rownum = 1
+            union all
+            select mail_id, from_addr, from_name, subject, delivered, 1
+            from latest
+            where rownum = 1 and ?4 > 0 and delivered <= ?5
+                and not exists (select 1 from dismissed_nudges where user_id = ?1 and mail_id = latest.mail_id)
+                -- a reminder the user set takes the place of a nudge
+                and not exists (select 1 from reminders where user_id = ?1 and sender_addr = latest.from_addr)
+                -- the user has written back since
+                and not exists (
+                    select 1 from sent_letters
+                    where user_id = ?1 and recipient_addr = lower(latest.from_addr) and orig_date >= latest.delivered
+                )
+        )
+        order by date desc
+        limit ?6
+    `
+	return loadMailArray[DueReminder](query, []any{userId, date, userAddr, nudgeDays, nudgeDate, limit})
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+/*
+Letters are written in a small, safe subset of Markdown: paragraphs, emphasis, lists,
+quotes and links. Rendering escapes all of the letter's text and only adds the tags below,
+so the HTML is safe to show without further sanitizing. Anything else is shown as written.
+*/
+
+var (
+	listItem    = regexp.MustCompile(`^[-*+] +`)
+	orderedItem = regexp.MustCompile(`^[0-9]{1,9}[.)] +`)
+	quoteLine   = regexp.MustCompile(`^> ?`)
+	mdLink      = regexp.MustCompile(`\[([^\[\]]+)\]\(([^()\s]+)\)`)
+	strong      = regexp.MustCompile(`(\*\*|__)([^\s*_](?:.*?[^\s*_])?)(\*\*|__)`)
+	emphasis    = regexp.MustCompile(`(^|[^\pL\pN*_])([*_])([^\s*_](?:[^*_]*?[^\s*_])?)([*_])($|[^\pL\pN*_])`)
+)
+
+// URL schemes that links can use
+var linkSchemes = []string{"http", "https", "mailto"}
+
+/*
+	renderMarkdown
+
+Renders the content of a letter as HTML. Lines within a paragraph keep their breaks,
+as they do in a written letter.
+*/
+func renderMarkdown(content string) template.HTML {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return template.HTML(renderBlocks(strings.Split(content, "\n")))
+}
+
+/* renderBlocks: renders lines as paragraphs, lists and quotes */
+func renderBlocks(lines []string) string {
+	var out strings.Builder
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case quoteLine.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && quoteLine.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quoteLine.ReplaceAllString(lines[i], ""))
+			}
+			out.WriteString("<blockquote>" + renderBlocks(quoted) + "</blockquote>")
+
+		case listItem.MatchString(line), orderedItem.MatchString(line):
+			marker := listItem
+			tag := "ul"
+			if orderedItem.MatchString(line) {
+				marker = orderedItem
+				tag = "ol"
+			}
+
+			out.WriteString("<" + tag + ">")
+			for i < len(lines) && marker.MatchString(lines[i]) {
+				item := []string{marker.ReplaceAllString(lines[i], "")}
+				// indented lines continue the item
+				for i++; i < len(lines) && strings.HasPrefix(lines[i], " ") && strings.TrimSpace(lines[i]) != ""; i++ {
+					item = append(item, strings.TrimSpace(lines[i]))
+				}
+				out.WriteString("<li>" + renderInline(strings.Join(item, "\n")) + "</li>")
+			}
+			out.WriteString("</" + tag + ">")
+
+		default:
+			var para []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && !startsBlock(lines[i]); i++ {
+				para = append(para, lines[i])
+			}
+			out.WriteString("<p>" + renderInline(strings.Join(para, "\n")) + "</p>")
+		}
+	}
+	return out.String()
+}
+
+/* startsBlock: whether a line starts a list or a quote, which ends a paragraph */
+func startsBlock(line string) bool {
+	return quoteLine.MatchString(line) || listItem.MatchString(line) || orderedItem.MatchString(line)
+}
+
+/*
+	renderInline
+
+Escapes text and renders its links and emphasis. Link addresses are kept apart from
+the emphasis rules, so underscores and asterisks in them are left alone.
+*/
+func renderInline(text string) string {
+	var out strings.Builder
+	for {
+		loc := mdLink.FindStringSubmatchIndex(text)
+		if loc == nil {
+			break
+		}
+		out.WriteString(renderEmphasis(text[:loc[0]]))
+
+		label, addr := text[loc[2]:loc[3]], text[loc[4]:loc[5]]
+		if safeLink(addr) {
+			out.WriteString(`<a href="` + template.HTMLEscapeString(addr) + `" rel="nofollow noreferrer">` +
+				renderEmphasis(label) + "</a>")
+		} else {
+			out.WriteString(template.HTMLEscapeString(text[loc[0]:loc[1]]))
+		}
+		text = text[loc[1]:]
+	}
+	out.WriteString(renderEmphasis(text))
+	return strings.ReplaceAll(out.String(), "\n", "<br>\n")
+}
+
+/* renderEmphasis: escapes text and renders its strong and emphasized spans */
+func renderEmphasis(text string) string {
+	text = template.HTMLEscapeString(text)
+	text = strong.ReplaceAllStringFunc(text, func(match string) string {
+		parts := strong.FindStringSubmatch(match)
+		if parts[1] != parts[3] {
+			return match
+		}
+		return "<strong>" + parts[2] + "</strong>"
+	})
+	// matches consume the character on either side, so spans separated by one character take a second pass
+	for range 2 {
+		text = emphasis.ReplaceAllStringFunc(text, func(match string) string {
+			parts := emphasis.FindStringSubmatch(match)
+			if parts[2] != parts[4] {
+				return match
+			}
+			return parts[1] + "<em>" + parts[3] + "</em>" + parts[5]
+		})
+	}
+	return text
+}
+
+/* safeLink: whether a link address is absolute with one of the allowed schemes */
+func safeLink(addr string) bool {
+	parsed, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	for _, scheme := range linkSchemes {
+		if strings.EqualFold(parsed.Scheme, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	markdownText
+
+The plain text of a letter written in Markdown, without its markup, for previews.
+Links are replaced by their text.
+*/
+func markdownText(content string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		for quoteLine.MatchString(line) {
+			line = quoteLine.ReplaceAllString(line, "")
+		}
+		line = listItem.ReplaceAllString(line, "")
+		line = orderedItem.ReplaceAllString(line, "")
+		line = mdLink.ReplaceAllString(line, "$1")
+		line = strong.ReplaceAllString(line, "$2")
+		line = emphasis.ReplaceAllString(line, "$1$3$5")
+		line = emphasis.ReplaceAllString(line, "$1$3$5")
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -1,5 +1,7 @@
 package main
 
+import "html/template"
+
 /* Data types that model application state */
 
 // data to pass to the signup page template
@@ -12,24 +14,242 @@ type loginData struct {
 	UserWrong bool
 	PassWrong bool
 	Username  string
+	CanReset  bool // whether password resets are on, to link to them
+	Reset     bool // whether the user just reset their password
 }
 
-// data to pass to the mailbox templates
-type mailboxData struct {
+// data for the page to ask for a password reset link
+type resetData struct {
+	Sent bool
+}
+
+// data for the page shown by a link to confirm a recovery address
+type recoveryConfirmData struct {
+	Invalid bool // the link is unknown, used or expired
+}
+
+// data for the page to choose a new password from a reset link
+type resetPasswordData struct {
+	Token        string
+	Invalid      bool // the link is unknown, used or expired
+	PassShort    bool
+	PassMismatch bool
+}
+
+// data for the account settings page. The form's values are kept when it has errors.
+type accountData struct {
+	navData
+	DisplayName     string
+	RecoveryAddr    string
+	PendingRecovery string // new recovery address waiting to be confirmed, if any
+	TimeZone        string
+	ContactsOnly    bool
+	NudgeDays       int
+	TimeZones       []string // suggested time zones
+	Saved           bool
+
+	// errors in the form, shown next to their fields
+	NameInvalid      bool
+	RecoveryInvalid  bool
+	RecoveryMismatch bool
+	PassWrong        bool
+	PassShort        bool
+	PassMismatch     bool
+	ZoneInvalid      bool
+	NudgeInvalid     bool
+}
+
+// data for the navigation bar, embedded in the data of every page that shows it
+type navData struct {
 	Username string
-	Date     string
-	Mails    []mailPreview
+	Unread   int // unread conversations in today's inbox
+	Requests int // senders with mail held in the requests folder
+	Labels   []Label
+}
+
+// links to the pages before and after a page, for the pages template. The keys are only
+// set for pages loaded with loadPage, and page numbers are 0 if there is no such page.
+type pageData struct {
 	PagePrev int
 	PageNext int
+	PrevKey  string // key of the first mail on the page
+	NextKey  string // key of the last mail on the page
+}
+
+// data to pass to the mailbox templates
+type mailboxData struct {
+	navData
+	pageData
+	Path      string // path and query of the page, for forms to return to
+	Date      string
+	Day       string // date in URL format
+	Mails     []mailPreview
+	Reminders []reminderPreview // reminders to reply, only shown in the inbox
+	NudgeDays int               // the user's preference, for the inbox
+}
+
+type reminderPreview struct {
+	MailId   int
+	FromName string
+	Subject  string
+	Nudge    bool   // about an unanswered letter, instead of a reminder the user set
+	Date     string // day the reminder was due, or the day the unanswered letter was delivered
+}
+
+// data for the trash template
+type trashData struct {
+	navData
+	pageData
+	Mails []trashPreview
+	Days  int // days that mail stays in the trash
+}
+
+type trashPreview struct {
+	MailId    int
+	FromName  string
+	Subject   string
+	Preview   string
+	PurgeDate string // day the mail will be permanently deleted
+}
+
+// data for the page of a past day's inbox
+type dayData struct {
+	mailboxData
+	PrevDay  string
+	NextDay  string // empty if the day is today
+	Calendar calendarData
+}
+
+// a month calendar
+type calendarData struct {
+	Month     string
+	Weeks     [][]calendarDay
+	PrevMonth string // first day of the previous month
+	NextMonth string // first day of the next month, empty if it is in the future
+}
+
+type calendarDay struct {
+	Day      int // 0 for blank days before the first of the month
+	Link     string
+	HasMail  bool
+	Selected bool
+	Future   bool
+}
+
+// data for the requests folder
+type requestsData struct {
+	mailboxData
+	ContactsOnly bool
+}
+
+// data for the page to manage blocked senders
+type blocksData struct {
+	navData
+	Blocks []Block
+}
+
+// data for the page of a draft's earlier revisions
+type revisionsData struct {
+	navData
+	Draft     Draft
+	Revisions []revisionDisplay
+}
+
+type revisionDisplay struct {
+	RevisionId int
+	Date       string
+	Subject    string
+	Content    string
+}
+
+// data for the page to manage signatures and letter templates
+type templatesData struct {
+	navData
+	Signatures []LetterTemplate
+	Templates  []LetterTemplate
+	NameExists bool
+}
+
+// data for the address book page
+type contactsData struct {
+	navData
+	Contacts    []Contact
+	Suggestions []SuggestedContact // senders that aren't contacts yet
+	AddrExists  bool
+}
+
+// data for the pen-pal directory
+type directoryData struct {
+	navData
+	Listing   *Listing // the user's own listing, or nil if they aren't listed
+	Query     string
+	Language  string
+	Languages []Language
+	Entries   []directoryEntry
+	pageData
+	PageQuery string // query string of the filter, for page links
+}
+
+type directoryEntry struct {
+	Name      string
+	Addr      string
+	Bio       string
+	Interests string
+	Language  string
+}
+
+// data for the statistics page
+type statsData struct {
+	navData
+	Months         []monthDisplay // months with letters in the last year, latest first
+	Correspondents []Correspondent
+	ReplyDays      string // average time the user takes to answer a letter, or empty if they haven't
+	PalReplyDays   string // average time others take to answer the user
+	ReceivedStreak *streakDisplay
+	SentStreak     *streakDisplay
+	Year           *yearInLetters // summary of last year, or nil if it had no letters
+}
+
+type monthDisplay struct {
+	Month    string
+	Received int
+	Sent     int
+}
+
+type streakDisplay struct {
+	Days  int
+	Start string
+	End   string
+}
+
+// the "year in letters", a summary of a year's letters
+type yearInLetters struct {
+	Year              int
+	Received          int
+	Sent              int
+	NewCorrespondents int    // people first written to or heard from that year
+	BusiestMonth      string // month with the most letters
+	Top               []Correspondent
+}
+
+// data for a label's folder
+type labelFolderData struct {
+	mailboxData
+	Label Label
+}
+
+// data for the page to manage labels
+type labelsData struct {
+	navData
+	NameExists bool
 }
 
 // data to pass to the draft templates
 type draftsData struct {
-	Username string
-	Date     string
-	Mails    []draftPreview
-	PagePrev int
-	PageNext int
+	navData
+	pageData
+	Date  string
+	Mails []draftPreview
 }
 
 type mailPreview struct {
@@ -37,6 +257,9 @@ type mailPreview struct {
 	FromName string
 	Subject  string
 	Preview  string
+	Archived bool
+	Read     bool
+	Earlier  int // earlier mail from the same sender that day, hidden by this one
 }
 
 type draftPreview struct {
@@ -47,24 +270,102 @@ type draftPreview struct {
 }
 
 type mailDisplay struct {
-	Date    string
-	Subject string
-	Content string
+	MailId      int
+	Date        string
+	Subject     string
+	Content     string
+	PlainText   bool          // the author chose plain text instead of Markdown
+	HTML        template.HTML // content rendered from Markdown, unless it is plain text
+	Unread      bool          // unread until this page view
+	Superseded  bool          // a later mail from the same sender was delivered the same day
+	Attachments []attachmentLink
+}
+
+type attachmentLink struct {
+	AttachmentId int
+	Filename     string
+	Size         string
+}
+
+// a label that can be put on a conversation
+type labelChoice struct {
+	Label
+	Checked bool
 }
 
 // data for the conversation view page
 type convData struct {
-	Username   string
+	navData
+	pageData
 	MailId     string
 	SenderName string
 	SenderAddr string
+	Archived   bool
+	Labels     []labelChoice
+	Templates  []LetterTemplate // signatures and letter templates that can be inserted into a reply
+	DraftId    int              // the saved reply, or 0 if there isn't one
+	Reminder   string           // day a reminder to reply is due, or empty if there isn't one
 	Draft      *mailDisplay
 	Mails      []mailDisplay
-	PagePrev   int
-	PageNext   int
 }
 
-// data for compose page
+// a conversation laid out as a book, for the book templates
+type bookData struct {
+	Id        string // identifies the book in its EPUB metadata
+	Title     string
+	Sender    string // name of the person who wrote the letters
+	Recipient string // name of the user they were written to
+	Months    []bookMonth
+}
+
+// a chapter of a book, with the letters delivered in a month
+type bookMonth struct {
+	Id      string
+	Name    string
+	Letters []bookLetter
+}
+
+type bookLetter struct {
+	Id        string
+	Date      string
+	Subject   string
+	Content   string
+	PlainText bool
+	HTML      template.HTML // content rendered from Markdown, unless it is plain text
+}
+
+// data for compose page. The fields are filled in when a form is shown again with an error.
 type composeData struct {
-	Username string
+	navData
+	Templates   []LetterTemplate // signatures and letter templates that can be inserted
+	DraftId     int              // draft being edited, or 0 for a new letter
+	Attachments []attachmentLink // attachments already on the draft
+	To          string
+	Subject     string
+	Content     string
+	PlainText   bool
+	Error       string
+}
+
+// data for the search page
+type searchData struct {
+	navData
+	Query     string
+	From      string
+	After     string
+	Before    string
+	Senders   []Sender
+	Searched  bool
+	Results   []searchResult
+	PageQuery string // query string of the search, for page links
+	PagePrev  int
+	PageNext  int
+}
+
+type searchResult struct {
+	MailId   int
+	FromName string
+	Subject  string
+	Date     string
+	Snippet  template.HTML // escaped, with matches highlighted
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+/*
+Passwords are hashed with argon2id, with a random salt for each hash. A hash is stored in
+the PHC string format, which records the parameters it was made with, so the parameters can
+be raised later without breaking existing hashes:
+
+	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+
+Older accounts have an unsalted SHA-512 hash, which is replaced when the user next logs in.
+*/
+
+// argon2id parameters for new hashes, from the second recommended option in RFC 9106
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // in KiB
+	argonThreads = 2
+	argonSaltLen = 16
+	argonKeyLen  = 32
+)
+
+var ErrBadHash = errors.New("password hash is not in a known format")
+
+var hashEncoding = base64.RawStdEncoding
+
+/* hashPassword: hashes a password with a new salt, in the PHC string format */
+func hashPassword(password string) ([]byte, error) {
+	salt := make([]byte, argonSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		hashEncoding.EncodeToString(salt), hashEncoding.EncodeToString(key))
+	return []byte(encoded), nil
+}
+
+/*
+	checkPassword
+
+Compares a password with a stored hash in constant time. The second return value is whether
+the hash should be replaced by a new one from hashPassword, because it is an old SHA-512
+hash or it was made with other parameters.
+*/
+func checkPassword(stored []byte, password string) (bool, bool, error) {
+	// a SHA-512 hash is raw bytes, so it can start like a PHC string, but it is never long enough to be one
+	if len(stored) == sha512.Size {
+		sum := sha512.Sum512([]byte(password))
+		return subtle.ConstantTimeCompare(sum[:], stored) == 1, true, nil
+	}
+
+	parts := strings.Split(string(stored), "$")
+	if !strings.HasPrefix(string(stored), "$argon2id$") || len(parts) != 6 {
+		return false, false, ErrBadHash
+	}
+	var version int
+	var memory, passes uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false, ErrBadHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &passes, &threads)
+	if err != nil {
+		return false, false, ErrBadHash
+	}
+	salt, err := hashEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrBadHash
+	}
+	key, err := hashEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, false, ErrBadHash
+	}
+
+	given := argon2.IDKey([]byte(password), salt, passes, memory, threads, uint32(len(key)))
+	outdated := memory != argonMemory || passes != argonTime || threads != argonThreads || len(salt) != argonSaltLen ||
+		len(key) != argonKeyLen
+	return subtle.ConstantTimeCompare(given, key) == 1, outdated, nil
+}
+
+/*
+	newResetToken
+
+Makes a random token for a password reset link, or a link to confirm a recovery address.
+The token goes in the link, and only its hash is saved, so the saved hashes can't be used
+in place of the links.
+*/
+func newResetToken() (string, []byte, error) {
+	randBytes := make([]byte, 32)
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(randBytes)
+	return token, hashResetToken(token), nil
+}
+
+/* hashResetToken: the hash of a password reset token, as it is saved */
+func hashResetToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
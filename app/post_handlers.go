@@ -2,14 +2,35 @@ package main
 
 import (
 	"crypto/rand"
-	"crypto/sha512"
 	"encoding/base64"
 	"errors"
+	"io"
+	"log"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// errors for uploads that are too large. These are user errors, and the messages are shown to the user.
+var (
+	errAttachmentLimit = errors.New("The attachments are larger than the limit for one letter.")
+	errAttachmentQuota = errors.New("There isn't enough space left in your account for these attachments.")
+	errRecipientQuota  = errors.New("There isn't enough space left in the recipient's account for these attachments.")
+	errDraftExists     = errors.New("You already have a draft to that recipient. Open it from your drafts instead.")
+)
+
+// memory for parsing multipart forms, beyond which uploads are stored in temporary files
+const maxFormMemory = 1 << 20
+
+// room for the text fields of a compose form, in addition to its attachments
+const maxFormText = 1 << 20
+
+// largest vCard file that can be imported
+const maxImportSize = 10 << 20
+
 /*
 	makeAuthedHandler
 
@@ -57,9 +78,13 @@ func postSignup(writer http.ResponseWriter, req *http.Request) {
 
 	username := req.PostForm.Get("username")
 	displayName := req.PostForm.Get("display_name")
-	password := sha512.Sum512([]byte(req.PostForm.Get("password")))
+	password, err := hashPassword(req.PostForm.Get("password"))
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
 
-	userid, dbErr := newUser(User{Username: username, DisplayName: displayName, Password: password[:]})
+	userid, dbErr := newUser(User{Username: username, DisplayName: displayName, Password: password})
 
 	if dbErr == ErrNotUnique {
 		renderPage(writer, req, signupData{true})
@@ -80,7 +105,8 @@ func postSignup(writer http.ResponseWriter, req *http.Request) {
 	postLogin
 
 This route handles missing username and missing passwords as user errors.
-All others are internal errors.
+All others are internal errors. A password hash in an old format is replaced
+once the password is checked.
 */
 func postLogin(writer http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
@@ -90,24 +116,290 @@ func postLogin(writer http.ResponseWriter, req *http.Request) {
 	}
 
 	username := req.PostForm.Get("username")
-	password := sha512.Sum512([]byte(req.PostForm.Get("password")))
+	password := req.PostForm.Get("password")
 
 	user, dbErr := loadUser(username)
 	if dbErr == ErrNotFound {
-		renderPage(writer, req, loginData{true, false, username})
+		renderPage(writer, req, loginData{UserWrong: true, Username: username, CanReset: transport != nil})
 		return
 	}
 	if dbErr != nil {
 		internalError(writer, dbErr)
 		return
 	}
-	if password != [64]byte(user.Password) {
-		renderPage(writer, req, loginData{false, true, username})
+	match, rehash, err := checkPassword(user.Password, password)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	if !match {
+		renderPage(writer, req, loginData{PassWrong: true, Username: username, CanReset: transport != nil})
 		return
 	}
+	if rehash {
+		newHash, err := hashPassword(password)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		err = updatePassword(user.UserId, newHash)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
 	startSession(writer, req, user.UserId)
 }
 
+/*
+	postAccount
+
+Saves the account settings form. The password is only changed if a new one is given, and
+changing it logs out the user's other sessions. Changing the password or the recovery
+address, which could be used to take over the account, needs the current password. Invalid
+fields are user errors: the form is shown again with the values given and nothing is saved.
+
+A new recovery address is only used once it is confirmed with a link sent to it, so that a
+mistyped address doesn't replace one that works. Until then reset links go to the old one.
+Without a mail transport no link can be sent, and the address is saved as it is.
+*/
+func postAccount(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	user, err := loadUser(session.Username)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	data := accountData{navData: nav, DisplayName: strings.TrimSpace(req.PostForm.Get("display_name")),
+		RecoveryAddr: strings.TrimSpace(req.PostForm.Get("recovery_addr")), TimeZone: strings.TrimSpace(req.PostForm.Get("time_zone")),
+		ContactsOnly: req.PostForm.Get("contacts_only") != "", TimeZones: suggestedTimeZones}
+	data.NameInvalid = data.DisplayName == "" || utf8.RuneCountInString(data.DisplayName) > maxDisplayName
+	if data.RecoveryAddr != "" && data.RecoveryAddr != user.RecoveryAddr {
+		local, domain, hasAt := strings.Cut(data.RecoveryAddr, "@")
+		data.RecoveryInvalid = !hasAt || local == "" || domain == "" || strings.ContainsAny(data.RecoveryAddr, " \t<>")
+		// a new address is typed twice, so a typo doesn't leave the account without a way back in
+		data.RecoveryMismatch = !data.RecoveryInvalid && strings.TrimSpace(req.PostForm.Get("recovery_confirm")) != data.RecoveryAddr
+	}
+	if data.TimeZone != "" {
+		_, err := time.LoadLocation(data.TimeZone)
+		data.ZoneInvalid = err != nil
+	}
+	data.NudgeDays, err = strconv.Atoi(req.PostForm.Get("nudge_days"))
+	data.NudgeInvalid = err != nil || data.NudgeDays < 0 || data.NudgeDays > maxReminderDays
+
+	newPassword := req.PostForm.Get("new_password")
+	if newPassword != "" || data.RecoveryAddr != user.RecoveryAddr {
+		match, _, err := checkPassword(user.Password, req.PostForm.Get("current_password"))
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		data.PassWrong = !match
+	}
+	if newPassword != "" {
+		data.PassShort = len(newPassword) < minPasswordLength
+		data.PassMismatch = req.PostForm.Get("confirm_password") != newPassword
+	}
+
+	if data.NameInvalid || data.RecoveryInvalid || data.RecoveryMismatch || data.ZoneInvalid || data.NudgeInvalid ||
+		data.PassWrong || data.PassShort || data.PassMismatch {
+		renderTemplate(writer, "account", data)
+		return
+	}
+
+	recoveryAddr := data.RecoveryAddr
+	pending := transport != nil && data.RecoveryAddr != "" && data.RecoveryAddr != user.RecoveryAddr
+	if pending {
+		recoveryAddr = user.RecoveryAddr
+	}
+	err = updateAccount(User{UserId: session.UserId, DisplayName: data.DisplayName, RecoveryAddr: recoveryAddr})
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	if pending {
+		token, tokenHash, err := newResetToken()
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		now := time.Now()
+		err = newRecoveryConfirmation(RecoveryConfirmation{TokenHash: tokenHash, UserId: session.UserId, Addr: data.RecoveryAddr,
+			Expiration: now.Add(recoveryExpiration).Unix()}, now.Unix())
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		go sendRecoveryLink(*user, data.RecoveryAddr, token)
+	} else if data.RecoveryAddr != user.RecoveryAddr {
+		// the address was removed, or saved without confirming it
+		err = deletePendingRecovery(session.UserId)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
+	err = updatePreferences(Preferences{UserId: session.UserId, ContactsOnly: data.ContactsOnly, NudgeDays: data.NudgeDays,
+		TimeZone: data.TimeZone})
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	if newPassword != "" {
+		password, err := hashPassword(newPassword)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		err = updatePassword(session.UserId, password)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		err = deleteOtherSessions(session.UserId, session.SessionId)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
+
+	http.Redirect(writer, req, "/account/?saved", http.StatusSeeOther)
+}
+
+/*
+	postResetRequest
+
+Sends a password reset link to the recovery address of the account with the username in
+the form. The page shown afterwards is the same whether or not the account exists or has
+a recovery address, and the link is sent in the background so the response doesn't take
+longer when it does. No new link is sent while the last one was sent less than
+resetInterval ago, so the form can't be used to flood the recovery address.
+*/
+func postResetRequest(writer http.ResponseWriter, req *http.Request) {
+	if transport == nil {
+		http.NotFound(writer, req)
+		return
+	}
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	user, err := loadUser(req.PostForm.Get("username"))
+	if err != nil && err != ErrNotFound {
+		internalError(writer, err)
+		return
+	}
+	now := time.Now()
+	var recent bool
+	if user != nil {
+		// links expire resetExpiration after they are sent
+		recent, err = hasRecentReset(user.UserId, now.Add(resetExpiration-resetInterval).Unix())
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
+	if user != nil && user.RecoveryAddr != "" && !recent {
+		token, tokenHash, err := newResetToken()
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		err = newPasswordReset(PasswordReset{TokenHash: tokenHash, UserId: user.UserId, Expiration: now.Add(resetExpiration).Unix()},
+			now.Unix())
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		go sendResetLink(*user, token)
+	}
+
+	renderTemplate(writer, "reset", resetData{Sent: true})
+}
+
+/* sendResetLink: sends a password reset link to a user's recovery address, logging any error */
+func sendResetLink(user User, token string) {
+	body := "Hello " + user.DisplayName + ",\n\n" +
+		"Someone asked to reset the password of your Slow Mail account, " + user.Username + "@" + host + ".\n" +
+		"To choose a new password, open this link within an hour:\n\n" +
+		baseURL + "/reset/" + token + "/\n\n" +
+		"If it wasn't you, you can ignore this message and your password won't change.\n"
+	err := transport.Send(user.RecoveryAddr, "Reset your Slow Mail password", body)
+	if err != nil {
+		log.Println("sending a password reset link: " + err.Error())
+	}
+}
+
+/* sendRecoveryLink: sends a link to confirm a new recovery address to that address, logging any error */
+func sendRecoveryLink(user User, addr string, token string) {
+	body := "Hello " + user.DisplayName + ",\n\n" +
+		"This address was given as the recovery address of the Slow Mail account " + user.Username + "@" + host + ".\n" +
+		"To confirm it, open this link within a day:\n\n" +
+		baseURL + "/account/recovery/" + token + "/\n\n" +
+		"Until then, password reset links are sent to the account's earlier recovery address. If you didn't\n" +
+		"ask for this, you can ignore this message.\n"
+	err := transport.Send(addr, "Confirm your Slow Mail recovery address", body)
+	if err != nil {
+		log.Println("sending a recovery address confirmation: " + err.Error())
+	}
+}
+
+/*
+	postResetPassword
+
+Sets a new password from a reset link, and logs the user out everywhere. The link only
+works once. An unknown, used or expired link, and an invalid password, are user errors.
+*/
+func postResetPassword(writer http.ResponseWriter, req *http.Request) {
+	if transport == nil {
+		http.NotFound(writer, req)
+		return
+	}
+	writer.Header().Set("Referrer-Policy", "no-referrer")
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	newPassword := req.PostForm.Get("new_password")
+	data := resetPasswordData{Token: req.PathValue("token"), PassShort: len(newPassword) < minPasswordLength,
+		PassMismatch: req.PostForm.Get("confirm_password") != newPassword}
+	if data.PassShort || data.PassMismatch {
+		renderTemplate(writer, "resetpassword", data)
+		return
+	}
+
+	password, err := hashPassword(newPassword)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	err = completePasswordReset(hashResetToken(data.Token), time.Now().Unix(), password)
+	if err == ErrNotFound {
+		renderTemplate(writer, "resetpassword", resetPasswordData{Token: data.Token, Invalid: true})
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/login/?reset", http.StatusSeeOther)
+}
+
 /*
 	startSession
 
@@ -151,98 +443,1532 @@ func logout(writer http.ResponseWriter, req *http.Request) {
 	http.Redirect(writer, req, "/login/", http.StatusSeeOther)
 }
 
-func postComposeSave(writer http.ResponseWriter, req *http.Request, session SessionUser) {
-	err := req.ParseForm()
-	if err != nil {
-		internalError(writer, err)
-		return
-	}
+/*
+	parseComposeForm
 
-	draft := Draft{UserId: session.UserId, Recipient: req.PostForm.Get("to"), Subject: req.PostForm.Get("subject"),
-		Content: req.PostForm.Get("content")}
-	err = newDraft(draft)
-	if err == ErrNotUnique {
-		// this err is not reportable, it is app state
-		// so it is safe to just reassign err
-		err = updateDraft(draft)
+Parses a compose or reply form, which is multipart if it has attachments. Returns
+errAttachmentLimit if the request is too large for the per-letter limit.
+*/
+func parseComposeForm(writer http.ResponseWriter, req *http.Request) error {
+	req.Body = http.MaxBytesReader(writer, req.Body, letterAttachmentLimit+maxFormText)
+	err := req.ParseMultipartForm(maxFormMemory)
+	// ParseMultipartForm has already parsed a form that isn't multipart
+	if err == http.ErrNotMultipart {
+		return nil
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errAttachmentLimit
 	}
+	return err
+}
 
-	if err != nil {
-		internalError(writer, err)
-		return
+/*
+	parseUploads
+
+Reads the files uploaded with a compose form as attachments, and sniffs their MIME types.
+The attachments are returned without ids or an owner, with their total size.
+
+`attached` is the size of any attachments already on the letter, and counts towards the
+per-letter limit. Returns errAttachmentLimit if the uploads don't fit in the limit for a letter.
+*/
+func parseUploads(req *http.Request, attached int64) ([]Attachment, int64, error) {
+	if req.MultipartForm == nil {
+		return nil, 0, nil
 	}
 
-	http.Redirect(writer, req, "/mail/folder/inbox", http.StatusSeeOther)
-}
+	var attachments []Attachment
+	var size int64
+	for _, header := range req.MultipartForm.File["attachment"] {
+		file, err := header.Open()
+		if err != nil {
+			return nil, 0, err
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, 0, err
+		}
 
-func postComposeSend(writer http.ResponseWriter, req *http.Request, session SessionUser) {
-	err := req.ParseForm()
-	if err != nil {
-		internalError(writer, err)
-		return
+		size += int64(len(data))
+		attachments = append(attachments, Attachment{Filename: filepath.Base(header.Filename),
+			MimeType: http.DetectContentType(data), Size: int64(len(data)), Data: data})
 	}
 
-	recipientAddr := req.PostForm.Get("to")
-	recipient, recipientHost, hasAt := strings.Cut(recipientAddr, "@")
-	if !hasAt {
-		internalError(writer, errors.New("malformed recipient email address"))
-		return
+	if attached+size > letterAttachmentLimit {
+		return nil, 0, errAttachmentLimit
 	}
-	subject := req.PostForm.Get("subject")
-	content := req.PostForm.Get("content")
+	return attachments, size, nil
+}
 
-	// first check if recipient exists
-	var user *User
-	if recipientHost == host {
-		user, err = loadUser(recipient)
+/*
+	checkAttachmentQuota
+
+Checks that `size` more bytes of attachments fit in the quota of the user who will store
+them. Returns `quotaErr` if they don't.
+*/
+func checkAttachmentQuota(userId int, size int64, quotaErr error) error {
+	if size == 0 {
+		return nil
 	}
-	var recipientId int
-	if recipientHost != host || err == ErrNotFound {
-		// recipient does not exist. Change mail to bounce back to sender.
-		recipientId = session.UserId
-		subject = "Not sent: " + subject
-		content = messageNotSent + "Recipient: " + recipient + "\n\n" + content
-	} else if err != nil {
-		internalError(writer, err)
-		return
-	} else {
-		// recipient found; set recipient ID
-		recipientId = user.UserId
+	usage, err := loadAttachmentUsage(userId)
+	if err != nil {
+		return err
 	}
-
-	currTime := time.Now()
-	currDate := time.Date(currTime.Year(), currTime.Month(), currTime.Day(), 0, 0, 0, 0, time.Local)
-	if time.Since(currDate) > timeOfDelivery {
-		// too early to deliver today
-		currDate = currDate.AddDate(0, 0, 1)
+	if usage+size > userAttachmentQuota {
+		return quotaErr
 	}
+	return nil
+}
 
-	name := session.DisplayName
-	addr := session.Username + "@" + host
+/*
+	renderComposeError
 
-	mail := Mail{UserId: recipientId,
-		Folder:    "inbox",
-		Read:      false,
-		OrigDate:  currTime.Unix(),
-		Date:      currDate.Unix(),
-		FromHead:  name + " <" + addr + ">",
-		FromName:  name,
-		FromAddr:  addr,
-		ToHead:    "",
-		MessageId: "",
-		InReplyTo: "",
-		Subject:   subject,
-		Content:   content,
-		MultiFrom: false,
-		MultiTo:   false}
+Shows the compose page again with the submitted values and an error message, for user
+errors in a compose or reply form.
+*/
+func renderComposeError(writer http.ResponseWriter, req *http.Request, session SessionUser, composeErr error) {
+	renderComposeForm(writer, req, session, req.FormValue("content"), composeErr.Error())
+}
 
-	err = newMail(mail)
+/* renderComposeForm: show the compose page filled in with the submitted form, but with `content` as its text */
+func renderComposeForm(writer http.ResponseWriter, req *http.Request, session SessionUser, content string, errMsg string) {
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	letterTemplates, err := loadTemplates(session.UserId)
 	if err != nil {
 		internalError(writer, err)
 		return
 	}
+	// a draft being edited is still saved to its own routes
+	draftId, _ := strconv.Atoi(req.PathValue("draftId"))
+	renderTemplate(writer, "compose", composeData{navData: nav, Templates: letterTemplates, DraftId: draftId, To: req.FormValue("to"),
+		Subject: req.FormValue("subject"), Content: content, PlainText: req.FormValue("plain_text") == "on", Error: errMsg})
+}
 
-	_ = deleteDraft(session.UserId, recipientAddr)
+/*
+	insertTemplate
 
-	http.Redirect(writer, req, "/mail/folder/inbox", http.StatusSeeOther)
+Adds the signature or letter template chosen in a compose or reply form to the end of
+`content`, with its placeholders filled in. Returns ErrNotFound if the user has no such template.
+*/
+func insertTemplate(req *http.Request, session SessionUser, content string) (string, error) {
+	letterTemplate, err := loadTemplate(session.UserId, req.PostForm.Get("template"))
+	if err != nil {
+		return "", err
+	}
+
+	filled, err := fillTemplate(session, letterTemplate.Content, req.PostForm.Get("to"))
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(content) == "" {
+		return filled, nil
+	}
+	return strings.TrimRight(content, "\r\n") + "\n\n" + filled, nil
+}
+
+/*
+	fillTemplate
+
+Fills in the placeholders of a signature or letter template for a letter to `recipientAddr`.
+{name} is the recipient's name, {my_name} is the user's name, and {date} is today's date.
+*/
+func fillTemplate(session SessionUser, content string, recipientAddr string) (string, error) {
+	name, err := recipientName(session.UserId, recipientAddr)
+	if err != nil {
+		return "", err
+	}
+	prefs, err := loadPreferences(session.UserId)
+	if err != nil {
+		return "", err
+	}
+
+	replacer := strings.NewReplacer("{name}", name, "{my_name}", session.DisplayName,
+		"{date}", time.Now().In(userLocation(prefs.TimeZone)).Format("January 2, 2006"))
+	return replacer.Replace(content), nil
+}
+
+/*
+	recipientName
+
+The name to call a recipient by: a local user's display name, or else the name they last
+wrote to the user with, or else the start of their address.
+*/
+func recipientName(userId int, addr string) (string, error) {
+	username, addrHost, _ := strings.Cut(addr, "@")
+	if addrHost == host {
+		user, err := loadUser(username)
+		if err == nil {
+			return user.DisplayName, nil
+		}
+		if err != ErrNotFound {
+			return "", err
+		}
+	}
+
+	name, err := loadContactName(userId, addr)
+	if err != nil && err != ErrNotFound {
+		return "", err
+	}
+	if name != "" {
+		return name, nil
+	}
+	return username, nil
+}
+
+/*
+	postComposeInsert
+
+Inserts a signature or letter template into the compose form, and shows the form again.
+Attachments are not kept, so they should be chosen after inserting.
+*/
+func postComposeInsert(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := parseComposeForm(writer, req)
+	if err == errAttachmentLimit {
+		renderComposeError(writer, req, session, err)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	content, err := insertTemplate(req, session, req.PostForm.Get("content"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	renderComposeForm(writer, req, session, content, "")
+}
+
+func postComposeSave(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	if !saveComposeForm(writer, req, session, nil) {
+		return
+	}
+
+	if strings.HasPrefix(req.URL.Path, "/mail/conv/") {
+		// saved from a conversation, so go back to it
+		http.Redirect(writer, req, strings.TrimSuffix(req.URL.Path, "save/")+"read/", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(writer, req, "/mail/folder/inbox", http.StatusSeeOther)
+}
+
+/*
+	saveComposeForm
+
+Saves a compose or reply form as a draft, with its attachments. A new draft replaces any
+draft to the same recipient. If `existing` is passed, that draft is updated instead, and
+may be moved to a different recipient.
+
+Responds to the request with an error page and returns false if the draft couldn't be saved.
+*/
+func saveComposeForm(writer http.ResponseWriter, req *http.Request, session SessionUser, existing *Draft) bool {
+	err := parseComposeForm(writer, req)
+	if err == errAttachmentLimit {
+		renderComposeError(writer, req, session, err)
+		return false
+	}
+	if err != nil {
+		internalError(writer, err)
+		return false
+	}
+
+	draft := Draft{UserId: session.UserId, Recipient: req.PostForm.Get("to"), Subject: req.PostForm.Get("subject"),
+		Content: req.PostForm.Get("content"), PlainText: req.PostForm.Get("plain_text") == "on"}
+
+	// a draft saved to insert a signature or letter template
+	if req.PostForm.Get("insert") != "" {
+		draft.Content, err = insertTemplate(req, session, draft.Content)
+		if err == ErrNotFound {
+			http.NotFound(writer, req)
+			return false
+		}
+		if err != nil {
+			internalError(writer, err)
+			return false
+		}
+	}
+
+	// attachments already on the draft count towards the limit
+	var attached int64
+	saved := existing
+	if saved == nil {
+		saved, err = loadDraft(session.UserId, draft.Recipient)
+		if err != nil && err != ErrNotFound {
+			internalError(writer, err)
+			return false
+		}
+	}
+	if saved != nil {
+		attached, err = sumAttachments(0, saved.DraftId)
+		if err != nil {
+			internalError(writer, err)
+			return false
+		}
+	}
+	uploads, size, err := parseUploads(req, attached)
+	if err == nil {
+		err = checkAttachmentQuota(session.UserId, size, errAttachmentQuota)
+	}
+	if err == errAttachmentLimit || err == errAttachmentQuota {
+		renderComposeError(writer, req, session, err)
+		return false
+	}
+	if err != nil {
+		internalError(writer, err)
+		return false
+	}
+
+	// keep the version being overwritten
+	if saved != nil {
+		err = reviseDraft(session.UserId, saved.DraftId, 0)
+		if err != nil {
+			internalError(writer, err)
+			return false
+		}
+	}
+
+	if existing != nil {
+		draft.DraftId = existing.DraftId
+		err = updateDraftById(draft)
+		if err == ErrNotUnique {
+			renderComposeError(writer, req, session, errDraftExists)
+			return false
+		}
+	} else {
+		err = newDraft(draft)
+		if err == ErrNotUnique {
+			// this err is not reportable, it is app state
+			// so it is safe to just reassign err
+			err = updateDraft(draft)
+		}
+	}
+
+	if err != nil {
+		internalError(writer, err)
+		return false
+	}
+
+	saved, err = loadDraft(session.UserId, draft.Recipient)
+	if err != nil {
+		internalError(writer, err)
+		return false
+	}
+	for _, a := range uploads {
+		a.UserId = session.UserId
+		a.DraftId = saved.DraftId
+		err = newAttachment(a)
+		if err != nil {
+			internalError(writer, err)
+			return false
+		}
+	}
+	return true
+}
+
+/* loadSessionDraft: load the draft in the request path, responding with 404 if the session user doesn't have it */
+func loadSessionDraft(writer http.ResponseWriter, req *http.Request, session SessionUser) *Draft {
+	draft, err := loadDraftById(session.UserId, req.PathValue("draftId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return nil
+	}
+	if err != nil {
+		internalError(writer, err)
+		return nil
+	}
+	return draft
+}
+
+/* postDraftEdit: save changes to a draft, which may change its recipient, and go back to editing it */
+func postDraftEdit(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	draft := loadSessionDraft(writer, req, session)
+	if draft == nil {
+		return
+	}
+
+	if !saveComposeForm(writer, req, session, draft) {
+		return
+	}
+	http.Redirect(writer, req, "/mail/draft/"+strconv.Itoa(draft.DraftId)+"/edit/", http.StatusSeeOther)
+}
+
+/*
+	postDraftSend
+
+Sends a draft as edited in the form. The draft is moved to the form's recipient first,
+so that sending finds its attachments and deletes it.
+*/
+func postDraftSend(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	draft := loadSessionDraft(writer, req, session)
+	if draft == nil {
+		return
+	}
+
+	err := parseComposeForm(writer, req)
+	if err == errAttachmentLimit {
+		renderComposeError(writer, req, session, err)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	draft.Recipient = req.PostForm.Get("to")
+	err = updateDraftById(*draft)
+	if err == ErrNotUnique {
+		renderComposeError(writer, req, session, errDraftExists)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	postComposeSend(writer, req, session)
+}
+
+/*
+	postAutosave
+
+Saves the text of a compose or reply form in the background. On a draft's own route it
+updates that draft; otherwise it saves a draft to the form's recipient, once there is one
+and the letter has some text. Attachments are only saved with the form itself.
+
+Responds with 204 when saved, or 409 if a draft can't move to a recipient that already has one.
+A draft saved by recipient is given in the Location header as its own autosave URL, so that the
+form saves to that draft from then on, even if its recipient changes.
+*/
+func postAutosave(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	draft := Draft{UserId: session.UserId, Recipient: req.PostForm.Get("to"), Subject: req.PostForm.Get("subject"),
+		Content: req.PostForm.Get("content"), PlainText: req.PostForm.Get("plain_text") == "on"}
+	interval := int64(autosaveRevisionInterval.Seconds())
+
+	if req.PathValue("draftId") != "" {
+		existing := loadSessionDraft(writer, req, session)
+		if existing == nil {
+			return
+		}
+
+		err = reviseDraft(session.UserId, existing.DraftId, interval)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		draft.DraftId = existing.DraftId
+		err = updateDraftById(draft)
+		if err == ErrNotUnique {
+			http.Error(writer, errDraftExists.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !strings.Contains(draft.Recipient, "@") || (draft.Subject == "" && draft.Content == "") {
+		// nothing to save yet
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	existing, err := loadDraft(session.UserId, draft.Recipient)
+	if err != nil && err != ErrNotFound {
+		internalError(writer, err)
+		return
+	}
+	if existing != nil {
+		err = reviseDraft(session.UserId, existing.DraftId, interval)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
+
+	err = newDraft(draft)
+	if err == ErrNotUnique {
+		err = updateDraft(draft)
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	saved, err := loadDraft(session.UserId, draft.Recipient)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	writer.Header().Set("Location", "/mail/draft/"+strconv.Itoa(saved.DraftId)+"/autosave/")
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+/* postRevisionRestore: replace a draft's text with an earlier revision, keeping the current text as a revision */
+func postRevisionRestore(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	draft := loadSessionDraft(writer, req, session)
+	if draft == nil {
+		return
+	}
+	revision, err := loadRevision(session.UserId, draft.DraftId, req.PathValue("revisionId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = reviseDraft(session.UserId, draft.DraftId, 0)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	draft.Subject = revision.Subject
+	draft.Content = revision.Content
+	err = updateDraftById(*draft)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/draft/"+strconv.Itoa(draft.DraftId)+"/edit/", http.StatusSeeOther)
+}
+
+/* postDraftDelete: delete a draft and its attachments */
+func postDraftDelete(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	draft := loadSessionDraft(writer, req, session)
+	if draft == nil {
+		return
+	}
+
+	err := deleteDraft(session.UserId, draft.Recipient)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	http.Redirect(writer, req, "/mail/folder/drafts/", http.StatusSeeOther)
+}
+
+func postComposeSend(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := parseComposeForm(writer, req)
+	if err == errAttachmentLimit {
+		renderComposeError(writer, req, session, err)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	recipientAddr := req.PostForm.Get("to")
+	recipient, recipientHost, hasAt := strings.Cut(recipientAddr, "@")
+	if !hasAt {
+		internalError(writer, errors.New("malformed recipient email address"))
+		return
+	}
+	subject := req.PostForm.Get("subject")
+	content := req.PostForm.Get("content")
+	plainText := req.PostForm.Get("plain_text") == "on"
+
+	// attachments saved on a draft are sent along with any new uploads
+	draft, err := loadDraft(session.UserId, recipientAddr)
+	if err != nil && err != ErrNotFound {
+		internalError(writer, err)
+		return
+	}
+	var attached int64
+	if draft != nil {
+		attached, err = sumAttachments(0, draft.DraftId)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
+	uploads, size, err := parseUploads(req, attached)
+	if err == errAttachmentLimit {
+		renderComposeError(writer, req, session, err)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	name := session.DisplayName
+	addr := session.Username + "@" + host
+
+	// first check if recipient exists
+	var user *User
+	if recipientHost == host {
+		user, err = loadUser(recipient)
+	}
+	var recipientId int
+	folder := "inbox"
+	if recipientHost != host || err == ErrNotFound {
+		// recipient does not exist. Change mail to bounce back to sender.
+		recipientId = session.UserId
+		subject = "Not sent: " + subject
+		notice := messageNotSent
+		if plainText {
+			notice = markdownText(messageNotSent)
+		}
+		content = notice + "Recipient: " + recipient + "\n\n" + content
+	} else if err != nil {
+		internalError(writer, err)
+		return
+	} else {
+		// recipient found; set recipient ID
+		recipientId = user.UserId
+
+		// hold the mail for approval if the recipient only accepts mail from people they know
+		folder, err = deliveryFolder(user.UserId, recipientAddr, session.UserId, addr)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
+
+	currTime := time.Now()
+	currDate := time.Date(currTime.Year(), currTime.Month(), currTime.Day(), 0, 0, 0, 0, time.Local)
+	if time.Since(currDate) > timeOfDelivery {
+		// too early to deliver today
+		currDate = currDate.AddDate(0, 0, 1)
+	}
+
+	mail := Mail{UserId: recipientId,
+		Folder:    folder,
+		Read:      false,
+		OrigDate:  currTime.Unix(),
+		Date:      currDate.Unix(),
+		FromHead:  name + " <" + addr + ">",
+		FromName:  name,
+		FromAddr:  addr,
+		ToHead:    "",
+		MessageId: "",
+		InReplyTo: "",
+		Subject:   subject,
+		Content:   content,
+		MultiFrom: false,
+		MultiTo:   false,
+		PlainText: plainText}
+
+	// mail to a recipient who blocked the sender is dropped, without telling the sender
+	blocked, err := isBlocked(recipientId, addr)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	if !blocked {
+		// attachments belong to the recipient once they are sent, so they count towards the
+		// recipient's quota. Those on the draft already count towards the sender's.
+		var draftId int
+		charged := size
+		if draft != nil {
+			draftId = draft.DraftId
+			if recipientId != session.UserId {
+				charged += attached
+			}
+		}
+		err = checkAttachmentQuota(recipientId, charged, errRecipientQuota)
+		if err == errRecipientQuota {
+			renderComposeError(writer, req, session, err)
+			return
+		}
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+
+		_, err = newMail(mail, uploads, draftId)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
+	// letters to addresses outside Slow Mail bounce, but the user still wrote back to them
+	if recipientHost != host || recipientId != session.UserId {
+		sent := SentLetter{UserId: session.UserId, RecipientAddr: strings.ToLower(recipientAddr), OrigDate: mail.OrigDate,
+			Date: mail.Date}
+		if user != nil {
+			sent.RecipientName = user.DisplayName
+		}
+		// the letter is sent even if this fails, so it is only missing from the statistics and nudges
+		err = newSentLetter(sent)
+		if err != nil {
+			log.Println("recording a sent letter: " + err.Error())
+		}
+	}
+
+	_ = deleteDraft(session.UserId, recipientAddr)
+	// replying takes care of any reminder to reply
+	_ = deleteReminder(session.UserId, recipientAddr)
+
+	http.Redirect(writer, req, "/mail/folder/inbox", http.StatusSeeOther)
+}
+
+/*
+	deliveryFolder
+
+Chooses the folder for mail from a sender to a recipient, who are both Slow Mail users.
+This is the inbox, unless the recipient only accepts mail from people they know and doesn't
+know the sender. Then it is the requests folder.
+*/
+func deliveryFolder(recipientId int, recipientAddr string, senderId int, senderAddr string) (string, error) {
+	prefs, err := loadPreferences(recipientId)
+	if err != nil || !prefs.ContactsOnly {
+		return "inbox", err
+	}
+
+	known, err := isKnownSender(recipientId, recipientAddr, senderId, senderAddr)
+	if err != nil || known {
+		return "inbox", err
+	}
+	return "requests", nil
+}
+
+/*
+	redirectReturn
+
+Redirects to the path in the form's "return" field, which forms set to the page they were
+submitted from. If it is missing or isn't a path on this site, redirects to `fallback`.
+*/
+func redirectReturn(writer http.ResponseWriter, req *http.Request, fallback string) {
+	path := req.PostForm.Get("return")
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.Contains(path, "\\") {
+		path = fallback
+	}
+	http.Redirect(writer, req, path, http.StatusSeeOther)
+}
+
+/*
+	postConvFolder
+
+Archives or unarchives the conversation with the sender of a mail, depending on the
+request path. Only mail that has already been delivered is moved.
+*/
+func postConvFolder(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	mailId := req.PathValue("mailId")
+	if mailId == "" {
+		internalError(writer, errors.New("could not parse mail id from conversation path"))
+		return
+	}
+	sender, err := loadSenderAddr(mailId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	folder := "archive"
+	if strings.HasSuffix(req.URL.Path, "/unarchive/") {
+		folder = "inbox"
+	}
+
+	err = updateConvFolder(session.UserId, sender.SenderAddr, folder, currDate().Unix())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	redirectReturn(writer, req, "/mail/folder/inbox/")
+}
+
+/*
+	postConvUnread
+
+Marks the conversation with the sender of a mail as unread, then returns to the inbox.
+*/
+func postConvUnread(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	mailId := req.PathValue("mailId")
+	if mailId == "" {
+		internalError(writer, errors.New("could not parse mail id from conversation path"))
+		return
+	}
+	sender, err := loadSenderAddr(mailId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = markConvUnread(session.UserId, sender.SenderAddr, currDate().Unix())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	redirectReturn(writer, req, "/mail/folder/inbox/")
+}
+
+/*
+	postInboxRead
+
+Marks all of today's inbox as read.
+*/
+func postInboxRead(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := markInboxRead(session.UserId, currDate().Unix())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/folder/inbox/", http.StatusSeeOther)
+}
+
+/*
+	postLabel
+
+Creates a label. A duplicate name is a user error, so the labels page is shown again.
+*/
+func postLabel(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = newLabel(Label{UserId: session.UserId, Name: req.PostForm.Get("name")})
+	if err == ErrNotUnique {
+		renderLabelsError(writer, session)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/labels/", http.StatusSeeOther)
+}
+
+/*
+	postLabelRename
+
+Renames a label. A duplicate name is a user error, so the labels page is shown again.
+*/
+func postLabelRename(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	label, err := loadLabel(session.UserId, req.PathValue("labelId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	label.Name = req.PostForm.Get("name")
+	err = renameLabel(*label)
+	if err == ErrNotUnique {
+		renderLabelsError(writer, session)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/labels/", http.StatusSeeOther)
+}
+
+/* renderLabelsError: show the labels page with a duplicate name error */
+func renderLabelsError(writer http.ResponseWriter, session SessionUser) {
+	nav, err := loadNav(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	renderTemplate(writer, "labels", labelsData{navData: nav, NameExists: true})
+}
+
+/* postLabelDelete: delete a label, which removes it from all conversations */
+func postLabelDelete(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	label, err := loadLabel(session.UserId, req.PathValue("labelId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = deleteLabel(session.UserId, label.LabelId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/labels/", http.StatusSeeOther)
+}
+
+/*
+	postConvLabels
+
+Sets the labels on the conversation with the sender of a mail to the checked labels in the form.
+*/
+func postConvLabels(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	mailId := req.PathValue("mailId")
+	if mailId == "" {
+		internalError(writer, errors.New("could not parse mail id from conversation path"))
+		return
+	}
+	sender, err := loadSenderAddr(mailId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = updateConvLabels(session.UserId, sender.SenderAddr, req.PostForm["label"])
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/conv/"+mailId+"/read/", http.StatusSeeOther)
+}
+
+/*
+	postConvTrash
+
+Moves the conversation with the sender of a mail to the trash, or restores it, depending on
+the request path.
+*/
+func postConvTrash(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	mailId := req.PathValue("mailId")
+	if mailId == "" {
+		internalError(writer, errors.New("could not parse mail id from conversation path"))
+		return
+	}
+	sender, err := loadSenderAddr(mailId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	if strings.HasSuffix(req.URL.Path, "/restore/") {
+		err = restoreConv(session.UserId, sender.SenderAddr)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		http.Redirect(writer, req, "/mail/folder/trash/", http.StatusSeeOther)
+		return
+	}
+
+	err = trashConv(session.UserId, sender.SenderAddr, currDate().Unix())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	http.Redirect(writer, req, "/mail/folder/inbox/", http.StatusSeeOther)
+}
+
+/*
+	postPieceTrash
+
+Moves a single mail to the trash, or restores it, depending on the request path.
+*/
+func postPieceTrash(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	mailId := req.PathValue("mailId")
+	if mailId == "" {
+		internalError(writer, errors.New("could not parse mail id from path"))
+		return
+	}
+
+	if strings.HasSuffix(req.URL.Path, "/restore/") {
+		err := restorePiece(session.UserId, mailId)
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+		http.Redirect(writer, req, "/mail/folder/trash/", http.StatusSeeOther)
+		return
+	}
+
+	err := trashPiece(session.UserId, mailId, currDate().Unix())
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	// the rest of the conversation can still be found from the trashed mail
+	http.Redirect(writer, req, "/mail/conv/"+mailId+"/read/", http.StatusSeeOther)
+}
+
+/*
+	postSnooze
+
+Snoozes a letter (/mail/piece/...) or a whole conversation (/mail/conv/...) until the day
+in the `until` field, which must be after today. It leaves the inbox and archive, and is
+delivered again in that day's inbox.
+*/
+func postSnooze(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	mailId := req.PathValue("mailId")
+	if mailId == "" {
+		internalError(writer, errors.New("could not parse mail id from path"))
+		return
+	}
+	today := currDate()
+	until, ok := parseDateParam(req, "until")
+	if !ok || !until.After(today) {
+		http.Error(writer, "Please choose a day after today.", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if strings.HasPrefix(req.URL.Path, "/mail/conv/") {
+		var sender Sender
+		sender, err = loadSenderAddr(mailId)
+		if err == ErrNotFound {
+			http.NotFound(writer, req)
+			return
+		}
+		if err == nil {
+			err = snoozeConv(session.UserId, sender.SenderAddr, until.Unix(), today.Unix())
+		}
+	} else {
+		err = snoozePiece(session.UserId, mailId, until.Unix(), today.Unix())
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/folder/inbox/", http.StatusSeeOther)
+}
+
+/*
+	postReminder
+
+Sets a reminder to reply to a conversation, due in the number of days in the `days` field.
+It is shown in the inbox from that day until it is dismissed or the user replies.
+*/
+func postReminder(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	mailId := req.PathValue("mailId")
+	days, err := strconv.Atoi(req.FormValue("days"))
+	if err != nil || days < 1 || days > maxReminderDays {
+		http.Error(writer, "Please choose a number of days from 1 to "+strconv.Itoa(maxReminderDays)+".", http.StatusBadRequest)
+		return
+	}
+	sender, err := loadSenderAddr(mailId)
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	due := currDate().AddDate(0, 0, days)
+	err = setReminder(Reminder{UserId: session.UserId, SenderAddr: sender.SenderAddr, Due: due.Unix()})
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/conv/"+mailId+"/read/", http.StatusSeeOther)
+}
+
+/*
+	postReminderDismiss
+
+Dismisses the reminder for a conversation, and the nudge about the mail in the path if it
+is unanswered.
+*/
+func postReminderDismiss(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	mailId := req.PathValue("mailId")
+	sender, err := loadSenderAddr(mailId)
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = deleteReminder(session.UserId, sender.SenderAddr)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	err = dismissNudge(session.UserId, mailId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	redirectReturn(writer, req, "/mail/folder/inbox/")
+}
+
+/* postNudgeDays: sets the days after which unanswered letters are shown as reminders, 0 for never */
+func postNudgeDays(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	days, err := strconv.Atoi(req.FormValue("nudge_days"))
+	if err != nil || days < 0 || days > maxReminderDays {
+		http.Error(writer, "Please choose a number of days from 0 to "+strconv.Itoa(maxReminderDays)+".", http.StatusBadRequest)
+		return
+	}
+
+	prefs, err := loadPreferences(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	prefs.NudgeDays = days
+
+	err = updatePreferences(prefs)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/folder/inbox/", http.StatusSeeOther)
+}
+
+/* postTrashEmpty: permanently delete everything in the trash */
+func postTrashEmpty(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := emptyTrash(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/folder/trash/", http.StatusSeeOther)
+}
+
+/*
+	postConvBlock
+
+Blocks the sender of a mail, which hides the conversation everywhere.
+*/
+func postConvBlock(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	mailId := req.PathValue("mailId")
+	if mailId == "" {
+		internalError(writer, errors.New("could not parse mail id from conversation path"))
+		return
+	}
+	sender, err := loadSenderAddr(mailId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = newBlock(Block{UserId: session.UserId, Blocked: sender.SenderAddr})
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/folder/inbox/", http.StatusSeeOther)
+}
+
+/*
+	postBlock
+
+Blocks an address, or a whole domain if the form value has no '@'. A leading '@' is
+allowed for domains.
+*/
+func postBlock(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	blocked := strings.TrimPrefix(strings.TrimSpace(req.PostForm.Get("blocked")), "@")
+	if blocked != "" {
+		err = newBlock(Block{UserId: session.UserId, Blocked: blocked})
+		if err != nil {
+			internalError(writer, err)
+			return
+		}
+	}
+
+	http.Redirect(writer, req, "/mail/blocks/", http.StatusSeeOther)
+}
+
+/* postUnblock: remove an address or domain from the block list */
+func postUnblock(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = deleteBlock(Block{UserId: session.UserId, Blocked: req.PostForm.Get("blocked")})
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/blocks/", http.StatusSeeOther)
+}
+
+/*
+	postRequest
+
+Accepts or declines the held mail from the sender of a mail, depending on the request path.
+Accepted mail moves to the inbox, and declined mail is permanently deleted.
+*/
+func postRequest(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	mailId := req.PathValue("mailId")
+	if mailId == "" {
+		internalError(writer, errors.New("could not parse mail id from request path"))
+		return
+	}
+	sender, err := loadSenderAddr(mailId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	if strings.HasSuffix(req.URL.Path, "/decline/") {
+		err = declineRequest(session.UserId, sender.SenderAddr)
+	} else {
+		err = acceptRequest(session.UserId, sender.SenderAddr)
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/folder/requests/", http.StatusSeeOther)
+}
+
+/*
+	postContactsOnly
+
+Turns contacts-only mode on or off, from the checkbox on the requests page.
+*/
+func postContactsOnly(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	prefs, err := loadPreferences(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	prefs.ContactsOnly = req.PostForm.Get("contacts_only") == "on"
+
+	err = updatePreferences(prefs)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/folder/requests/", http.StatusSeeOther)
+}
+
+/*
+	postTemplate
+
+Creates a signature or letter template. A duplicate name is a user error, so the templates
+page is shown again.
+*/
+func postTemplate(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	kind := req.PostForm.Get("kind")
+	if kind != "signature" && kind != "template" {
+		internalError(writer, errors.New("unknown kind of letter template"))
+		return
+	}
+
+	err = newTemplate(LetterTemplate{UserId: session.UserId, Kind: kind, Name: req.PostForm.Get("name"),
+		Content: req.PostForm.Get("content")})
+	if err == ErrNotUnique {
+		renderTemplatesError(writer, session)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/templates/", http.StatusSeeOther)
+}
+
+/*
+	postTemplateEdit
+
+Updates the name and content of a signature or letter template. A duplicate name is a
+user error, so the templates page is shown again.
+*/
+func postTemplateEdit(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	letterTemplate, err := loadTemplate(session.UserId, req.PathValue("templateId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	letterTemplate.Name = req.PostForm.Get("name")
+	letterTemplate.Content = req.PostForm.Get("content")
+	err = updateTemplate(*letterTemplate)
+	if err == ErrNotUnique {
+		renderTemplatesError(writer, session)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/templates/", http.StatusSeeOther)
+}
+
+/* renderTemplatesError: show the templates page with a duplicate name error */
+func renderTemplatesError(writer http.ResponseWriter, session SessionUser) {
+	data, err := loadTemplatesData(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	data.NameExists = true
+	renderTemplate(writer, "templates", data)
+}
+
+/* postTemplateDelete: delete a signature or letter template */
+func postTemplateDelete(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	letterTemplate, err := loadTemplate(session.UserId, req.PathValue("templateId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = deleteTemplate(session.UserId, letterTemplate.TemplateId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/templates/", http.StatusSeeOther)
+}
+
+/*
+	postContact
+
+Adds a contact. An address that is already a contact is a user error, so the address book
+is shown again.
+*/
+func postContact(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = newContact(Contact{UserId: session.UserId, Addr: strings.TrimSpace(req.PostForm.Get("addr")),
+		Nickname: strings.TrimSpace(req.PostForm.Get("nickname")), Notes: req.PostForm.Get("notes")})
+	if err == ErrNotUnique {
+		renderContactsError(writer, session)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/contacts/", http.StatusSeeOther)
+}
+
+/*
+	postContactEdit
+
+Updates a contact. Changing its address to one that is already a contact is a user error,
+so the address book is shown again.
+*/
+func postContactEdit(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	contact, err := loadContact(session.UserId, req.PathValue("contactId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	contact.Addr = strings.TrimSpace(req.PostForm.Get("addr"))
+	contact.Nickname = strings.TrimSpace(req.PostForm.Get("nickname"))
+	contact.Notes = req.PostForm.Get("notes")
+	err = updateContact(*contact)
+	if err == ErrNotUnique {
+		renderContactsError(writer, session)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/contacts/", http.StatusSeeOther)
+}
+
+/* renderContactsError: show the address book with a duplicate address error */
+func renderContactsError(writer http.ResponseWriter, session SessionUser) {
+	data, err := loadContactsData(session)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	data.AddrExists = true
+	renderTemplate(writer, "contacts", data)
+}
+
+/* postContactDelete: delete a contact */
+func postContactDelete(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	contact, err := loadContact(session.UserId, req.PathValue("contactId"))
+	if err == ErrNotFound {
+		http.NotFound(writer, req)
+		return
+	}
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = deleteContact(session.UserId, contact.ContactId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/contacts/", http.StatusSeeOther)
+}
+
+/*
+	postContactsImport
+
+Adds the contacts in an uploaded vCard file. Addresses that are already contacts are
+left as they are.
+*/
+func postContactsImport(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	req.Body = http.MaxBytesReader(writer, req.Body, maxImportSize)
+	file, _, err := req.FormFile("vcard")
+	if err != nil {
+		// no file, or one that is too large
+		http.Error(writer, "Please choose a vCard file of at most 10 MB.", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	contacts, err := parseVCards(file)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+	for _, c := range contacts {
+		c.UserId = session.UserId
+		err = newContact(c)
+		if err != nil && err != ErrNotUnique {
+			internalError(writer, err)
+			return
+		}
+	}
+
+	http.Redirect(writer, req, "/mail/contacts/", http.StatusSeeOther)
+}
+
+/* postListing: list the user in the pen-pal directory, or update their listing */
+func postListing(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := req.ParseForm()
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	err = updateListing(Listing{UserId: session.UserId, Bio: strings.TrimSpace(req.PostForm.Get("bio")),
+		Interests: strings.TrimSpace(req.PostForm.Get("interests")), Language: strings.TrimSpace(req.PostForm.Get("language"))})
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/directory/", http.StatusSeeOther)
+}
+
+/* postListingRemove: remove the user from the pen-pal directory */
+func postListingRemove(writer http.ResponseWriter, req *http.Request, session SessionUser) {
+	err := deleteListing(session.UserId)
+	if err != nil {
+		internalError(writer, err)
+		return
+	}
+
+	http.Redirect(writer, req, "/mail/directory/", http.StatusSeeOther)
 }
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha512"
+	"html/template"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // The tests make the following assumptions about the test database (see error messages):
@@ -85,6 +94,299 @@ func TestPostLogin(t *testing.T) {
 	}
 }
 
+func TestPostLoginRehash(t *testing.T) {
+	// an account with an old, unsalted hash
+	oldHash := sha512.Sum512([]byte("rehash"))
+	_, err := newUser(User{Username: "rehash", DisplayName: "rehash", Password: oldHash[:]})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from users where username = 'rehash'")
+
+	login := func(password string) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/login/", strings.NewReader("username=rehash&password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		postLogin(rw, req)
+		return rw.Code
+	}
+
+	if code := login("wrong"); code != 200 {
+		t.Errorf("Expected status 200 for a wrong password; got %d", code)
+	}
+	if code := login("rehash"); code != 303 {
+		t.Fatalf("Expected status 303; got %d", code)
+	}
+	user, err := loadUser("rehash")
+	if err != nil || !strings.HasPrefix(string(user.Password), "$argon2id$") {
+		t.Fatalf("Expected the hash to be replaced with an argon2id hash; got %v", err)
+	}
+	if code := login("rehash"); code != 303 {
+		t.Errorf("Expected status 303 with the new hash; got %d", code)
+	}
+	if code := login("wrong"); code != 200 {
+		t.Errorf("Expected status 200 for a wrong password with the new hash; got %d", code)
+	}
+
+	// an old hash can start with the same byte as the new format
+	for i := 0; ; i++ {
+		password := "dollar" + strconv.Itoa(i)
+		sum := sha512.Sum512([]byte(password))
+		if sum[0] != '$' {
+			continue
+		}
+		ok, rehash, err := checkPassword(sum[:], password)
+		if err != nil || !ok || !rehash {
+			t.Errorf("Expected an old hash starting with $ to match and be replaced; got %t, %t, %v", ok, rehash, err)
+		}
+		break
+	}
+}
+
+func TestPostAccount(t *testing.T) {
+	password, err := hashPassword("account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userId, err := newUser(User{Username: "account", DisplayName: "account", Password: password})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from users where username = 'account'")
+	defer db.Exec("delete from preferences where user_id = ?", *userId)
+	defer db.Exec("delete from sessions where user_id = ?", *userId)
+	for _, sessionId := range []string{"acct1", "acct2"} {
+		err = newSession(Session{sessionId, *userId, 0, "127.0.0.1", 9999999999})
+		if err != nil {
+			t.Fatalf("Database error: %s", err.Error())
+		}
+	}
+
+	post := func(form string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/account/", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: "acct1"})
+		makeAuthedHandler(postAccount)(rw, req)
+		return rw
+	}
+
+	// a wrong current password shows the form again and saves nothing
+	rw := post("display_name=Renamed&nudge_days=0&current_password=wrong&new_password=changed&confirm_password=changed")
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), "That isn't your current password") {
+		t.Errorf("Expected the form again with an error; got %d", rw.Code)
+	}
+	if user, _ := loadUser("account"); user.DisplayName != "account" {
+		t.Error("Expected nothing to be saved from a form with errors")
+	}
+
+	// so is a new recovery address without the current password
+	rw = post("display_name=account&nudge_days=0&recovery_addr=thief@example.com&recovery_confirm=thief@example.com")
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), "That isn't your current password") {
+		t.Errorf("Expected the form again with an error; got %d", rw.Code)
+	}
+	if user, _ := loadUser("account"); user.RecoveryAddr != "" {
+		t.Error("Expected the recovery address not to change without the current password")
+	}
+
+	rw = post("display_name=Renamed&recovery_addr=me@example.com&recovery_confirm=me@example.com&time_zone=Europe/Paris&nudge_days=3" +
+		"&current_password=account&new_password=changed&confirm_password=changed")
+	if rw.Code != 303 {
+		t.Fatalf("Expected status 303; got %d", rw.Code)
+	}
+	user, err := loadUser("account")
+	if err != nil || user.DisplayName != "Renamed" || user.RecoveryAddr != "me@example.com" {
+		t.Errorf("Expected the account to be updated; got %v", err)
+	}
+	if match, _, _ := checkPassword(user.Password, "changed"); !match {
+		t.Error("Expected the password to be changed")
+	}
+	prefs, err := loadPreferences(*userId)
+	if err != nil || prefs.TimeZone != "Europe/Paris" || prefs.NudgeDays != 3 {
+		t.Errorf("Expected the preferences to be updated; got %v", err)
+	}
+	if _, err := loadSession("acct2"); err != ErrNotFound {
+		t.Error("Expected the other session to be logged out")
+	}
+	if _, err := loadSession("acct1"); err != nil {
+		t.Error("Expected the current session to stay logged in")
+	}
+
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/account/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "acct1"})
+	makeAuthedHandler(getAccount)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), "me@example.com") {
+		t.Errorf("Expected the account page with the saved settings; got %d", rw.Code)
+	}
+}
+
+func TestRecoveryConfirmation(t *testing.T) {
+	outbox := t.TempDir()
+	transport = fileTransport{Dir: outbox, From: "no-reply@localhost"}
+	base := baseURL
+	baseURL = "http://localhost"
+	defer func() { transport, baseURL = nil, base }()
+
+	password, err := hashPassword("recover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userId, err := newUser(User{Username: "recover", DisplayName: "recover", Password: password, RecoveryAddr: "old@example.com"})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from users where username = 'recover'")
+	defer db.Exec("delete from recovery_confirmations where user_id = ?", *userId)
+	err = newSession(Session{"recover1", *userId, 0, "127.0.0.1", 9999999999})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from sessions where user_id = ?", *userId)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/account/", strings.NewReader("display_name=recover&nudge_days=0&current_password=recover"+
+		"&recovery_addr=new@example.com&recovery_confirm=new@example.com"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "recover1"})
+	makeAuthedHandler(postAccount)(rw, req)
+	if rw.Code != 303 {
+		t.Fatalf("Expected status 303; got %d", rw.Code)
+	}
+
+	// resets keep going to the old address until the new one is confirmed
+	if user, _ := loadUser("recover"); user.RecoveryAddr != "old@example.com" {
+		t.Errorf("Expected the old recovery address to be kept; got %q", user.RecoveryAddr)
+	}
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/account/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "recover1"})
+	makeAuthedHandler(getAccount)(rw, req)
+	if !strings.Contains(rw.Body.String(), "A link to confirm new@example.com was sent") {
+		t.Error("Expected the account page to show the address waiting to be confirmed")
+	}
+
+	// the link is sent in the background, to the new address
+	var sent []byte
+	for range 100 {
+		files, _ := os.ReadDir(outbox)
+		if len(files) == 1 && strings.HasSuffix(files[0].Name(), ".eml") {
+			sent, _ = os.ReadFile(outbox + "/" + files[0].Name())
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	link := regexp.MustCompile(`http://localhost/account/recovery/([A-Za-z0-9_-]+)/`).FindSubmatch(sent)
+	if !bytes.Contains(sent, []byte("To: new@example.com")) || link == nil {
+		t.Fatalf("Expected one message with a confirmation link to the new address; got %q", sent)
+	}
+
+	get := func(token string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/account/recovery/"+token+"/", nil)
+		req.SetPathValue("token", token)
+		getRecoveryConfirm(rw, req)
+		return rw
+	}
+	if rw := get("wrong"); rw.Code != 200 || !strings.Contains(rw.Body.String(), "Link expired") {
+		t.Errorf("Expected an unknown link not to work; got %d", rw.Code)
+	}
+	if rw := get(string(link[1])); rw.Code != 200 || !strings.Contains(rw.Body.String(), "Recovery address confirmed") {
+		t.Errorf("Expected the link to confirm the address; got %d", rw.Code)
+	}
+	if user, _ := loadUser("recover"); user.RecoveryAddr != "new@example.com" {
+		t.Errorf("Expected the new recovery address to be saved; got %q", user.RecoveryAddr)
+	}
+	if rw := get(string(link[1])); !strings.Contains(rw.Body.String(), "Link expired") {
+		t.Error("Expected the link to work only once")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	outbox := t.TempDir()
+	transport = fileTransport{Dir: outbox, From: "no-reply@localhost"}
+	base := baseURL
+	baseURL = "http://localhost"
+	defer func() { transport, baseURL = nil, base }()
+
+	password, err := hashPassword("forgotten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userId, err := newUser(User{Username: "resetme", DisplayName: "resetme", Password: password, RecoveryAddr: "resetme@example.com"})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from users where username = 'resetme'")
+	defer db.Exec("delete from password_resets where user_id = ?", *userId)
+	err = newSession(Session{"resetme", *userId, 0, "127.0.0.1", 9999999999})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from sessions where user_id = ?", *userId)
+
+	post := func(path string, handler http.HandlerFunc, form string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token, found := strings.CutPrefix(path, "/reset/"); found && token != "" {
+			req.SetPathValue("token", strings.TrimSuffix(token, "/"))
+		}
+		handler(rw, req)
+		return rw
+	}
+
+	// the response doesn't tell whether the account exists
+	unknown := post("/reset/", postResetRequest, "username=nobody")
+	known := post("/reset/", postResetRequest, "username=resetme")
+	if known.Code != 200 || known.Body.String() != unknown.Body.String() {
+		t.Errorf("Expected the same page for known and unknown accounts; got %d", known.Code)
+	}
+
+	// the link is sent in the background
+	var sent []byte
+	for range 100 {
+		files, _ := os.ReadDir(outbox)
+		if len(files) == 1 && strings.HasSuffix(files[0].Name(), ".eml") {
+			sent, _ = os.ReadFile(outbox + "/" + files[0].Name())
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	link := regexp.MustCompile(`http://localhost(/reset/[A-Za-z0-9_-]+/)`).FindSubmatch(sent)
+	if !bytes.Contains(sent, []byte("To: resetme@example.com")) || link == nil {
+		t.Fatalf("Expected one message with a reset link to the recovery address; got %q", sent)
+	}
+	path := string(link[1])
+
+	// another request soon after doesn't send a new link, and the first one still works
+	post("/reset/", postResetRequest, "username=resetme")
+	time.Sleep(100 * time.Millisecond)
+	if files, _ := os.ReadDir(outbox); len(files) != 1 {
+		t.Errorf("Expected no new link to be sent so soon; got %d messages", len(files))
+	}
+
+	if rw := post(path, postResetPassword, "new_password=remembered&confirm_password=other"); !strings.Contains(rw.Body.String(), "don't match") {
+		t.Error("Expected the form again for passwords that don't match")
+	}
+	rw := post(path, postResetPassword, "new_password=remembered&confirm_password=remembered")
+	if rw.Code != 303 {
+		t.Fatalf("Expected status 303; got %d", rw.Code)
+	}
+	if _, err := loadSession("resetme"); err != ErrNotFound {
+		t.Error("Expected the user's sessions to be logged out")
+	}
+	if rw := post("/login/", postLogin, "username=resetme&password=remembered"); rw.Code != 303 {
+		t.Errorf("Expected to log in with the new password; got %d", rw.Code)
+	}
+
+	// a link works once
+	rw = post(path, postResetPassword, "new_password=again&confirm_password=again")
+	if !strings.Contains(rw.Body.String(), "Link expired") {
+		t.Error("Expected a used link not to work again")
+	}
+}
+
 func TestGetCompose(t *testing.T) {
 	rw := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "/mail/compose/", nil)
@@ -153,6 +455,123 @@ func TestPostDraftSave(t *testing.T) {
 	}
 }
 
+func TestPostDraftEdit(t *testing.T) {
+	err := newDraft(Draft{UserId: 1, Recipient: "first@localhost", Subject: "draft", Content: "edit me"})
+	if err != nil && err != ErrNotUnique {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	draft, err := loadDraft(1, "first@localhost")
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	draftId := strconv.Itoa(draft.DraftId)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/draft/"+draftId+"/edit/", nil)
+	req.SetPathValue("draftId", draftId)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getDraftEdit)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), "edit me") {
+		checkSession(t)
+		t.Errorf("Expected status 200 with the draft; got %d", rw.Code)
+	}
+
+	// change the recipient
+	rw = httptest.NewRecorder()
+	body := strings.NewReader("to=second%40localhost&subject=draft&content=edited")
+	req = httptest.NewRequest("POST", "/mail/draft/"+draftId+"/edit/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetPathValue("draftId", draftId)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postDraftEdit)(rw, req)
+	if rw.Code != 303 {
+		t.Errorf("Expected status 303; got %d", rw.Code)
+	}
+	moved, err := loadDraft(1, "second@localhost")
+	if err != nil || moved.DraftId != draft.DraftId || moved.Content != "edited" {
+		t.Errorf("Expected the draft to move to the new recipient; got %v", err)
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/mail/draft/"+draftId+"/delete/", nil)
+	req.SetPathValue("draftId", draftId)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postDraftDelete)(rw, req)
+	if rw.Code != 303 {
+		t.Errorf("Expected status 303; got %d", rw.Code)
+	}
+	_, err = loadDraftById(1, draftId)
+	if err != ErrNotFound {
+		t.Errorf("Expected the draft to be deleted; got %v", err)
+	}
+}
+
+func TestPostAutosave(t *testing.T) {
+	var location string
+	for _, content := range []string{"first", "second"} {
+		rw := httptest.NewRecorder()
+		body := strings.NewReader("to=autosave%40localhost&subject=revised&content=" + content)
+		req := httptest.NewRequest("POST", "/mail/compose/autosave/", body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+		makeAuthedHandler(postAutosave)(rw, req)
+		if rw.Code != 204 {
+			checkSession(t)
+			t.Fatalf("Expected status 204; got %d", rw.Code)
+		}
+		location = rw.Header().Get("Location")
+	}
+
+	draft, err := loadDraft(1, "autosave@localhost")
+	if err != nil || draft.Content != "second" {
+		t.Fatalf("Expected the autosaved draft; got %v", err)
+	}
+	if location != "/mail/draft/"+strconv.Itoa(draft.DraftId)+"/autosave/" {
+		t.Errorf("Expected the draft's autosave URL in the Location header; got %q", location)
+	}
+	revisions, err := loadRevisions(1, draft.DraftId)
+	if err != nil || len(revisions) != 1 || revisions[0].Content != "first" {
+		t.Fatalf("Expected the first version as a revision; got %d, %v", len(revisions), err)
+	}
+	draftId := strconv.Itoa(draft.DraftId)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/draft/"+draftId+"/revisions/", nil)
+	req.SetPathValue("draftId", draftId)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getRevisions)(rw, req)
+	if rw.Code != 200 {
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	revisionId := strconv.Itoa(revisions[0].RevisionId)
+	req = httptest.NewRequest("POST", "/mail/draft/"+draftId+"/revisions/"+revisionId+"/restore/", nil)
+	req.SetPathValue("draftId", draftId)
+	req.SetPathValue("revisionId", revisionId)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postRevisionRestore)(rw, req)
+	draft, err = loadDraft(1, "autosave@localhost")
+	if rw.Code != 303 || err != nil || draft.Content != "first" {
+		t.Errorf("Expected status 303 and the first version restored; got %d, %v", rw.Code, err)
+	}
+	revisions, err = loadRevisions(1, draft.DraftId)
+	if err != nil || len(revisions) != 2 || revisions[0].Content != "second" {
+		t.Errorf("Expected the replaced version as a revision; got %d, %v", len(revisions), err)
+	}
+
+	err = deleteDraft(1, "autosave@localhost")
+	if err != nil {
+		t.Errorf("Database error: %s", err.Error())
+	}
+}
+
 func TestPostComposeSend(t *testing.T) {
 	rw := httptest.NewRecorder()
 	body := strings.NewReader("to=test%40localhost&subject=test%20subject&content=nothing%20here")
@@ -207,6 +626,96 @@ func TestGetArchive(t *testing.T) {
 	}
 }
 
+func TestGetArchivePages(t *testing.T) {
+	// a page and one more of mail from new senders, newer than any other mail
+	for i := range mailPerPage + 1 {
+		addr := "pal" + strconv.Itoa(i) + "@localhost"
+		_, err := db.Exec(`insert into mail values (null, 1, 'archive', 1, ?, 0, ?, 'pen pal', ?, '', '', '', ?, '', 0, 0, 0)`,
+			1<<40+i, addr, addr, "paging-"+strconv.Itoa(i)+"-")
+		if err != nil {
+			t.Fatalf("Database error: %s", err.Error())
+		}
+	}
+	defer db.Exec("delete from mail where subject like 'paging-%'")
+
+	getPage := func(query string) string {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/mail/folder/archive/"+query, nil)
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+		makeAuthedHandler(getMailbox)(rw, req)
+		if rw.Code != 200 {
+			t.Fatalf("Expected status 200; got %d", rw.Code)
+		}
+		return rw.Body.String()
+	}
+
+	page := getPage("")
+	next := regexp.MustCompile(`href="(\?page=2&after=[0-9.]+)"`).FindStringSubmatch(page)
+	if !strings.Contains(page, "paging-1-") || strings.Contains(page, "paging-0-") || next == nil {
+		t.Fatal("Expected the first page to link to the second by the key of its last mail")
+	}
+
+	page = getPage(next[1])
+	prev := regexp.MustCompile(`href="(\?page=1&before=[0-9.]+)"`).FindStringSubmatch(page)
+	if !strings.Contains(page, "paging-0-") || strings.Contains(page, "paging-1-") || prev == nil {
+		t.Fatal("Expected the second page to start after the first, and link back to it")
+	}
+
+	page = getPage(prev[1])
+	if !strings.Contains(page, "paging-12-") || strings.Contains(page, "paging-0-") {
+		t.Error("Expected the link back to load the first page again")
+	}
+
+	// out of range pages show the first page
+	page = getPage("?page=2&after=0.0")
+	if !strings.Contains(page, "paging-12-") {
+		t.Error("Expected a page past the end to show the first page")
+	}
+}
+
+func TestGetDay(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/day/1970-01-01/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("date", "1970-01-01")
+
+	makeAuthedHandler(getDay)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/mail/day/9999-01-01/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("date", "9999-01-01")
+
+	makeAuthedHandler(getDay)(rw, req)
+	if rw.Code != 404 {
+		t.Errorf("Expected status 404 for a future day; got %d", rw.Code)
+	}
+
+	// a day whose mail was all archived still shows it, as the calendar marks the day
+	day := currDate().AddDate(0, 0, -2)
+	_, err := db.Exec(`insert into mail values (null, 1, 'archive', 1, ?, ?, 'dayarchive@localhost', 'Day Archive',
+		'dayarchive@localhost', '', '', '', 'archived on the day', '', 0, 0, 0)`, day.Unix()-3600, day.Unix())
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from mail where from_addr = 'dayarchive@localhost'")
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/mail/day/"+day.Format(urlDateFormat)+"/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("date", day.Format(urlDateFormat))
+
+	makeAuthedHandler(getDay)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), "archived on the day") {
+		t.Errorf("Expected status 200 with the archived mail; got %d", rw.Code)
+	}
+}
+
 func TestGetDrafts(t *testing.T) {
 	rw := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "/mail/folder/drafts/", nil)
@@ -233,6 +742,963 @@ func TestGetConv(t *testing.T) {
 	}
 }
 
+func TestGetSuperseded(t *testing.T) {
+	today := currDate()
+	var mailId int64
+	for i, subject := range []string{"first-of-two", "second-of-two"} {
+		result, err := db.Exec(`insert into mail values (null, 1, 'inbox', 0, ?, ?, 'twice@localhost', 'Twice', 'twice@localhost',
+			'', '', '', ?, '', 0, 0, 0)`, today.Unix()-100+int64(i), today.Unix(), subject)
+		if err != nil {
+			t.Fatalf("Database error: %s", err.Error())
+		}
+		mailId, _ = result.LastInsertId()
+	}
+	defer db.Exec("delete from mail where from_addr = 'twice@localhost'")
+	defer func() { dropSuperseded = false }()
+
+	get := func(path string, handler func(http.ResponseWriter, *http.Request, SessionUser)) string {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+		req.SetPathValue("mailId", strconv.FormatInt(mailId, 10))
+		makeAuthedHandler(handler)(rw, req)
+		if rw.Code != 200 {
+			t.Fatalf("Expected status 200; got %d", rw.Code)
+		}
+		return rw.Body.String()
+	}
+
+	for _, drop := range []bool{false, true} {
+		dropSuperseded = drop
+		inbox := get("/mail/folder/inbox/", getMailbox)
+		if !strings.Contains(inbox, "second-of-two") || strings.Contains(inbox, "+1 earlier letter today") == drop {
+			t.Errorf("Expected the latest letter in the inbox, counting the earlier one unless it is dropped (drop %v)", drop)
+		}
+		conv := get("/mail/conv/1/read/", getConv)
+		if !strings.Contains(conv, "second-of-two") || strings.Contains(conv, "first-of-two") == drop {
+			t.Errorf("Expected the earlier letter in the conversation unless it is dropped (drop %v)", drop)
+		}
+		if strings.Contains(conv, "Superseded by a later letter") == drop {
+			t.Errorf("Expected the earlier letter to be marked superseded unless it is dropped (drop %v)", drop)
+		}
+	}
+}
+
+func TestGetConvMarkdown(t *testing.T) {
+	// mail to a user that doesn't exist bounces back with a notice
+	rw := httptest.NewRecorder()
+	body := strings.NewReader("to=nobody%40localhost&subject=markdown&content=a%20*letter*&plain_text=on")
+	req := httptest.NewRequest("POST", "/mail/compose/send/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postComposeSend)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		t.Fatalf("Expected status 303; got %d", rw.Code)
+	}
+
+	var count Count
+	err := loadSingleRow("select plain_text from mail where subject = 'Not sent: markdown'", nil, &count)
+	if err != nil || count.N != 1 {
+		t.Errorf("Expected the letter to be saved as plain text; got %d, %v", count.N, err)
+	}
+
+	// a delivered letter written in Markdown
+	mailId, err := newMail(Mail{UserId: 1, Folder: "inbox", FromHead: "markdown@localhost", FromName: "Markdown",
+		FromAddr: "markdown@localhost", MessageId: "markdown-letter", Subject: "markdown",
+		Content: messageNotSent + "a *letter*"}, nil, 0)
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/mail/conv/"+strconv.Itoa(mailId)+"/read/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("mailId", strconv.Itoa(mailId))
+
+	makeAuthedHandler(getConv)(rw, req)
+	page := rw.Body.String()
+	if rw.Code != 200 || !strings.Contains(page, "<strong>Sorry") || !strings.Contains(page, "a <em>letter</em>") {
+		t.Errorf("Expected status 200 with the letter rendered from Markdown; got %d", rw.Code)
+	}
+}
+
+func TestGetForward(t *testing.T) {
+	mailId, err := newMail(Mail{UserId: 1, Folder: "archive", Read: true, FromHead: "forward@localhost", FromName: "Forward",
+		FromAddr: "forward@localhost", MessageId: "forward-letter", Subject: "pass it on", Content: "worth sharing"}, nil, 0)
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from mail where from_addr = 'forward@localhost'")
+	defer db.Exec("delete from mail_fts where rowid = ?", mailId)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/piece/"+strconv.Itoa(mailId)+"/forward/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("mailId", strconv.Itoa(mailId))
+
+	makeAuthedHandler(getForward)(rw, req)
+	page := rw.Body.String()
+	if rw.Code != 200 || !strings.Contains(page, "Fwd: pass it on") || !strings.Contains(page, "&gt; worth sharing") {
+		checkSession(t)
+		t.Errorf("Expected status 200 with the letter quoted; got %d", rw.Code)
+	}
+}
+
+func TestGetBook(t *testing.T) {
+	mailId, err := newMail(Mail{UserId: 1, Folder: "archive", Read: true, FromHead: "book@localhost", FromName: "Book",
+		FromAddr: "book@localhost", MessageId: "book-letter", Subject: "for the book", Content: "a letter worth keeping"}, nil, 0)
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from mail where from_addr = 'book@localhost'")
+	defer db.Exec("delete from mail_fts where rowid = ?", mailId)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/conv/"+strconv.Itoa(mailId)+"/export/epub/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("mailId", strconv.Itoa(mailId))
+	req.SetPathValue("format", "epub")
+
+	makeAuthedHandler(getBook)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Fatalf("Expected status 200; got %d", rw.Code)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rw.Body.Bytes()), int64(rw.Body.Len()))
+	if err != nil || archive.File[0].Name != "mimetype" {
+		t.Fatalf("Expected an EPUB file starting with its mimetype; got %v", err)
+	}
+	for _, f := range archive.File {
+		if f.Name == "OEBPS/book.xhtml" {
+			text, _ := f.Open()
+			content, _ := io.ReadAll(text)
+			if !strings.Contains(string(content), "a letter worth keeping") {
+				t.Error("Expected the book to contain the conversation's letters")
+			}
+		}
+	}
+
+	rw = httptest.NewRecorder()
+	req.SetPathValue("format", "pdf")
+	makeAuthedHandler(getBook)(rw, req)
+	if rw.Code != 404 {
+		t.Errorf("Expected status 404 for an unknown format; got %d", rw.Code)
+	}
+}
+
+func TestGetSearch(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/search/?q=test+%22subject&after=2000-01-01&before=nonsense", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getSearch)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+}
+
+func TestPostConvArchive(t *testing.T) {
+	rw := httptest.NewRecorder()
+	body := strings.NewReader("return=%2Fmail%2Ffolder%2Farchive%2F")
+	req := httptest.NewRequest("POST", "/mail/conv/1/archive/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("mailId", "1")
+
+	makeAuthedHandler(postConvFolder)(rw, req)
+
+	response := rw.Result()
+	location, _ := response.Location()
+	if response.StatusCode != 303 || location.Path != "/mail/folder/archive/" {
+		checkSession(t)
+		checkMail(t)
+		t.Errorf("Expected status 303 to '/mail/folder/archive/'; got status %d, '%s'", rw.Code, location.Path)
+	}
+
+	rw = httptest.NewRecorder()
+	body = strings.NewReader("return=%2F%2Fexample.com")
+	req = httptest.NewRequest("POST", "/mail/conv/1/unarchive/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("mailId", "1")
+
+	makeAuthedHandler(postConvFolder)(rw, req)
+
+	response = rw.Result()
+	location, _ = response.Location()
+	if response.StatusCode != 303 || location.Path != "/mail/folder/inbox/" {
+		t.Errorf("Expected status 303 to '/mail/folder/inbox/' for an offsite return path; got status %d, '%s'", rw.Code, location.Path)
+	}
+}
+
+func TestPostConvUnread(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/mail/conv/1/unread/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("mailId", "1")
+
+	makeAuthedHandler(postConvUnread)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		checkMail(t)
+		t.Errorf("Expected status 303; got %d", rw.Code)
+	}
+}
+
+func TestPostSnooze(t *testing.T) {
+	today := currDate()
+	result, err := db.Exec(`insert into mail values (null, 1, 'archive', 1, ?, ?, 'snooze@localhost', 'Snooze', 'snooze@localhost',
+		'', '', '', 'snoozed', '', 0, 0, 0)`, today.Unix()-3600, today.Unix())
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	mailId, _ := result.LastInsertId()
+	defer db.Exec("delete from snoozes where mail_id = ?", mailId)
+	defer db.Exec("delete from mail where from_addr = 'snooze@localhost'")
+
+	later := today.AddDate(0, 0, 2)
+	for _, until := range []string{"", today.Format(urlDateFormat), later.Format(urlDateFormat)} {
+		rw := httptest.NewRecorder()
+		body := strings.NewReader("until=" + until)
+		req := httptest.NewRequest("POST", "/mail/piece/1/snooze/", body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+		req.SetPathValue("mailId", strconv.FormatInt(mailId, 10))
+
+		makeAuthedHandler(postSnooze)(rw, req)
+		if until == later.Format(urlDateFormat) && rw.Code != 303 {
+			t.Fatalf("Expected status 303; got %d", rw.Code)
+		} else if until != later.Format(urlDateFormat) && rw.Code != 400 {
+			t.Errorf("Expected status 400 for a day that isn't after today; got %d", rw.Code)
+		}
+	}
+
+	archive, err := loadArchive(1, today.Unix(), PageCursor{})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	for _, m := range archive.Rows {
+		if m.FromAddr == "snooze@localhost" {
+			t.Error("Expected snoozed mail to be left out of the archive")
+		}
+	}
+	_, err = loadDeliveredMail(1, strconv.FormatInt(mailId, 10), today.Unix())
+	if err != ErrNotFound {
+		t.Errorf("Expected snoozed mail not to be found until it is delivered again; got %v", err)
+	}
+	senders, err := loadSenders(1, today.Unix())
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	for _, s := range senders {
+		if s.SenderAddr == "snooze@localhost" {
+			t.Error("Expected the sender of snoozed mail to be left out of the senders")
+		}
+	}
+
+	// it is delivered again, unread, in the inbox of the day it was snoozed to
+	inbox, err := loadInbox(1, later.Unix(), PageCursor{})
+	if err != nil || len(inbox.Rows) != 1 || inbox.Rows[0].Read || inbox.Rows[0].Date != today.Unix() {
+		t.Errorf("Expected the mail in that day's inbox, unread, with its original date; got %v", err)
+	}
+
+	// a snoozed conversation keeps its earlier letters, which weren't delivered on the same day
+	for _, days := range []int{-10, -5, 0} {
+		delivered := today.AddDate(0, 0, days)
+		_, err := db.Exec(`insert into mail values (null, 1, 'archive', 1, ?, ?, 'snoozeconv@localhost', 'Snooze',
+			'snoozeconv@localhost', '', '', '', ?, '', 0, 0, 0)`, delivered.Unix()-3600, delivered.Unix(), "day "+strconv.Itoa(days))
+		if err != nil {
+			t.Fatalf("Database error: %s", err.Error())
+		}
+	}
+	defer db.Exec("delete from mail where from_addr = 'snoozeconv@localhost'")
+	defer db.Exec("delete from snoozes where mail_id in (select mail_id from mail where from_addr = 'snoozeconv@localhost')")
+	err = snoozeConv(1, "snoozeconv@localhost", later.Unix(), today.Unix())
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+
+	drop := dropSuperseded
+	defer func() { dropSuperseded = drop }()
+	dropSuperseded = false
+	inbox, err = loadInbox(1, later.Unix(), PageCursor{})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	for _, m := range inbox.Rows {
+		if m.FromAddr == "snoozeconv@localhost" && (m.Subject != "day 0" || m.Earlier != 0) {
+			t.Errorf("Expected the latest letter without earlier letters that day; got %q, %d", m.Subject, m.Earlier)
+		}
+	}
+	dropSuperseded = true
+	conv, err := loadWholeConv(1, "snoozeconv@localhost", later.Unix())
+	if err != nil || len(conv) != 3 {
+		t.Errorf("Expected all three letters in the conversation; got %d, %v", len(conv), err)
+	}
+}
+
+func TestPostReminder(t *testing.T) {
+	today := currDate()
+	result, err := db.Exec(`insert into mail values (null, 1, 'archive', 1, ?, ?, 'remind@localhost', 'Remind', 'remind@localhost',
+		'', '', '', 'answer me', '', 0, 0, 0)`, today.Unix()-3600, today.Unix())
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	mailId, _ := result.LastInsertId()
+	defer db.Exec("delete from mail where from_addr = 'remind@localhost'")
+	defer db.Exec("delete from reminders where sender_addr = 'remind@localhost'")
+
+	post := func(path string, handler func(http.ResponseWriter, *http.Request, SessionUser), form string) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+		req.SetPathValue("mailId", strconv.FormatInt(mailId, 10))
+
+		makeAuthedHandler(handler)(rw, req)
+		return rw.Code
+	}
+
+	if code := post("/mail/conv/1/remind/", postReminder, "days=0"); code != 400 {
+		t.Errorf("Expected status 400 for 0 days; got %d", code)
+	}
+	if code := post("/mail/conv/1/remind/", postReminder, "days=3"); code != 303 {
+		t.Fatalf("Expected status 303; got %d", code)
+	}
+	reminder, err := loadReminder(1, "remind@localhost")
+	if err != nil || reminder.Due != today.AddDate(0, 0, 3).Unix() {
+		t.Fatalf("Expected a reminder due in 3 days; got %v", err)
+	}
+
+	// a reminder that is due today is shown in the inbox
+	err = setReminder(Reminder{UserId: 1, SenderAddr: "remind@localhost", Due: today.Unix()})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/folder/inbox/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	makeAuthedHandler(getMailbox)(rw, req)
+	if !strings.Contains(rw.Body.String(), "Reminders to reply") || !strings.Contains(rw.Body.String(), "answer me") {
+		t.Error("Expected the due reminder in the inbox")
+	}
+
+	if code := post("/mail/conv/1/remind/dismiss/", postReminderDismiss, "return=/mail/folder/inbox/"); code != 303 {
+		t.Fatalf("Expected status 303; got %d", code)
+	}
+	if _, err := loadReminder(1, "remind@localhost"); err != ErrNotFound {
+		t.Errorf("Expected the reminder to be dismissed; got %v", err)
+	}
+
+	// a nudge about a letter from outside Slow Mail stops once the user writes back
+	delivered := today.AddDate(0, 0, -10)
+	_, err = db.Exec(`insert into mail values (null, 1, 'archive', 1, ?, ?, 'nudge@example.com', 'Nudge', 'nudge@example.com',
+		'', '', '', 'write soon', '', 0, 0, 0)`, delivered.Unix()-3600, delivered.Unix())
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from mail where from_addr = 'nudge@example.com' or subject = 'Not sent: nudge'")
+	defer db.Exec("delete from mail_fts where rowid in (select mail_id from mail where subject = 'Not sent: nudge')")
+	defer db.Exec("delete from sent_letters where recipient_addr = 'nudge@example.com'")
+	nudged := func() bool {
+		due, err := loadDueReminders(1, "test@localhost", today.Unix(), 3, today.AddDate(0, 0, -3).Unix(), 100)
+		if err != nil {
+			t.Fatalf("Database error: %s", err.Error())
+		}
+		for _, d := range due {
+			if d.FromAddr == "nudge@example.com" && d.Nudge {
+				return true
+			}
+		}
+		return false
+	}
+	if !nudged() {
+		t.Error("Expected a nudge about the unanswered letter")
+	}
+	if code := post("/mail/compose/send/", postComposeSend, "to=nudge%40example.com&subject=nudge&content=sorry"); code != 303 {
+		t.Fatalf("Expected status 303; got %d", code)
+	}
+	if nudged() {
+		t.Error("Expected no nudge once the user wrote back")
+	}
+}
+
+func TestPostInboxRead(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/mail/folder/inbox/read/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postInboxRead)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		t.Errorf("Expected status 303; got %d", rw.Code)
+	}
+}
+
+func TestPostLabel(t *testing.T) {
+	query := "delete from labels where name = 'test' and user_id = 1;"
+	_, err := db.Exec(query)
+	if err != nil {
+		t.Errorf("Database error: %s", err.Error())
+	}
+
+	rw := httptest.NewRecorder()
+	body := strings.NewReader("name=test")
+	req := httptest.NewRequest("POST", "/mail/labels/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postLabel)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		t.Errorf("Expected status 303; got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	makeAuthedHandler(postLabel)(rw, req)
+	if rw.Code != 200 {
+		t.Errorf("After creating a duplicate label, expected status 200 to fill out again; got %d", rw.Code)
+	}
+}
+
+func TestGetLabels(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/labels/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getLabels)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+}
+
+func TestGetLabelFolder(t *testing.T) {
+	var label Label
+	err := loadSingleRow("select label_id, user_id, name from labels where name = 'test' and user_id = 1", []any{}, &label)
+	if err != nil {
+		t.Fatalf("Testing label folders requires the label created by TestPostLabel: %s", err.Error())
+	}
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/folder/label/1/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("labelId", strconv.Itoa(label.LabelId))
+
+	makeAuthedHandler(getLabelFolder)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+}
+
+func TestPostPieceTrash(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/mail/piece/1/delete/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("mailId", "1")
+
+	makeAuthedHandler(postPieceTrash)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		checkMail(t)
+		t.Errorf("Expected status 303 after delete; got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/mail/piece/1/restore/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("mailId", "1")
+
+	makeAuthedHandler(postPieceTrash)(rw, req)
+	if rw.Code != 303 {
+		t.Errorf("Expected status 303 after restore; got %d", rw.Code)
+	}
+	checkMail(t)
+}
+
+func TestGetTrash(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/folder/trash/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getTrash)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+}
+
+func TestPostBlock(t *testing.T) {
+	rw := httptest.NewRecorder()
+	body := strings.NewReader("blocked=%40Example.com")
+	req := httptest.NewRequest("POST", "/mail/blocks/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postBlock)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		t.Errorf("Expected status 303 after block; got %d", rw.Code)
+	}
+	blocked, err := isBlocked(1, "someone@example.com")
+	if err != nil || !blocked {
+		t.Errorf("Expected domain example.com to be blocked; got %t, %v", blocked, err)
+	}
+
+	rw = httptest.NewRecorder()
+	body = strings.NewReader("blocked=example.com")
+	req = httptest.NewRequest("POST", "/mail/blocks/unblock/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postUnblock)(rw, req)
+	if rw.Code != 303 {
+		t.Errorf("Expected status 303 after unblock; got %d", rw.Code)
+	}
+	blocked, err = isBlocked(1, "someone@example.com")
+	if err != nil || blocked {
+		t.Errorf("Expected domain example.com to be unblocked; got %t, %v", blocked, err)
+	}
+}
+
+func TestGetBlocks(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/blocks/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getBlocks)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+}
+
+func TestGetRequests(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/folder/requests/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getRequests)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+}
+
+func TestPostContactsOnly(t *testing.T) {
+	rw := httptest.NewRecorder()
+	body := strings.NewReader("contacts_only=on")
+	req := httptest.NewRequest("POST", "/mail/folder/requests/settings/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postContactsOnly)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		t.Errorf("Expected status 303; got %d", rw.Code)
+	}
+
+	// a correspondent is known whatever the case of their address
+	_, err := db.Exec(`insert into mail values (null, 1, 'archive', 1, 0, 0, 'known@localhost', 'Known', 'known@localhost',
+		'', '', '', 'known', '', 0, 0, 0)`)
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from mail where from_addr = 'known@localhost'")
+	folder, err := deliveryFolder(1, "test@localhost", 0, "Known@localhost")
+	if err != nil || folder != "inbox" {
+		t.Errorf("Expected mail from a known sender in the inbox; got %q, %v", folder, err)
+	}
+
+	// turn it back off for the other tests
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/mail/folder/requests/settings/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postContactsOnly)(rw, req)
+	prefs, err := loadPreferences(1)
+	if err != nil || prefs.ContactsOnly {
+		t.Errorf("Expected contacts-only mode to be off; got %t, %v", prefs.ContactsOnly, err)
+	}
+}
+
+// makeComposeBody builds a multipart compose form with one attached file
+func makeComposeBody(t *testing.T, filename string, data string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("to", "test@localhost")
+	form.WriteField("subject", "attachment test")
+	form.WriteField("content", "see attached")
+	file, err := form.CreateFormFile("attachment", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(data))
+	form.Close()
+	return body, form.FormDataContentType()
+}
+
+func TestPostAttachment(t *testing.T) {
+	body, contentType := makeComposeBody(t, "notes.txt", "some notes")
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/mail/compose/send/", body)
+	req.Header.Set("Content-Type", contentType)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postComposeSend)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		t.Fatalf("Expected status 303; got %d", rw.Code)
+	}
+
+	var count Count
+	err := loadSingleRow("select max(attachment_id) from attachments where filename = 'notes.txt' and mail_id is not null", nil, &count)
+	if err != nil || count.N == 0 {
+		t.Fatalf("Expected the attachment to be saved on the sent mail; got %v", err)
+	}
+	attachmentId := strconv.Itoa(count.N)
+
+	// the mail isn't delivered until tomorrow
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/mail/attachment/"+attachmentId+"/", nil)
+	req.SetPathValue("attachmentId", attachmentId)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getAttachment)(rw, req)
+	if rw.Code != 404 {
+		t.Errorf("Expected status 404 before delivery; got %d", rw.Code)
+	}
+
+	_, err = db.Exec("update mail set date = 0 where mail_id = (select mail_id from attachments where attachment_id = ?)", attachmentId)
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+
+	rw = httptest.NewRecorder()
+	makeAuthedHandler(getAttachment)(rw, req)
+	if rw.Code != 200 || rw.Body.String() != "some notes" {
+		t.Errorf("Expected status 200 with the file after delivery; got %d", rw.Code)
+	}
+	if rw.Header().Get("Content-Disposition") != `attachment; filename=notes.txt` {
+		t.Errorf("Expected the attachment to be served as a download; got '%s'", rw.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestPostAttachmentLimit(t *testing.T) {
+	limit := letterAttachmentLimit
+	letterAttachmentLimit = 4
+	defer func() { letterAttachmentLimit = limit }()
+
+	body, contentType := makeComposeBody(t, "large.txt", "too large")
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/mail/compose/", body)
+	req.Header.Set("Content-Type", contentType)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postComposeSave)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), errAttachmentLimit.Error()) {
+		checkSession(t)
+		t.Errorf("Expected status 200 with the compose page and an error; got %d", rw.Code)
+	}
+}
+
+func TestPostAttachmentQuota(t *testing.T) {
+	quota := userAttachmentQuota
+	userAttachmentQuota = 4
+	defer func() { userAttachmentQuota = quota }()
+	password, err := hashPassword("quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userId, err := newUser(User{Username: "quota", DisplayName: "quota", Password: password})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from users where username = 'quota'")
+	defer db.Exec("delete from mail where user_id = ?", *userId)
+
+	// sent attachments are stored by the recipient, so they count towards the recipient's quota
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("to", "quota@localhost")
+	form.WriteField("subject", "quota test")
+	file, err := form.CreateFormFile("attachment", "large.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("too large"))
+	form.Close()
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/mail/compose/send/", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postComposeSend)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), template.HTMLEscapeString(errRecipientQuota.Error())) {
+		t.Errorf("Expected status 200 with the compose page and an error; got %d", rw.Code)
+	}
+	var count Count
+	err = loadSingleRow("select count(*) from mail where user_id = ?", []any{*userId}, &count)
+	if err != nil || count.N != 0 {
+		t.Errorf("Expected no mail to be sent; got %d, %v", count.N, err)
+	}
+}
+
+func TestPostTemplate(t *testing.T) {
+	for _, expected := range []int{303, 200} {
+		// the second try is a duplicate name, which shows the templates page with an error
+		rw := httptest.NewRecorder()
+		body := strings.NewReader("kind=signature&name=formal&content=Dear%20%7Bname%7D%2C%0A%0AYours%2C%20%7Bmy_name%7D")
+		req := httptest.NewRequest("POST", "/mail/templates/", body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+		makeAuthedHandler(postTemplate)(rw, req)
+		if rw.Code != expected {
+			checkSession(t)
+			t.Errorf("Expected status %d; got %d", expected, rw.Code)
+		}
+	}
+}
+
+func TestPostComposeInsert(t *testing.T) {
+	letterTemplates, err := loadTemplates(1)
+	if err != nil || len(letterTemplates) == 0 {
+		t.Fatalf("Expected a template from TestPostTemplate; got %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	templateId := strconv.Itoa(letterTemplates[0].TemplateId)
+	body := strings.NewReader("to=test%40localhost&subject=hello&content=&insert=on&template=" + templateId)
+	req := httptest.NewRequest("POST", "/mail/compose/insert/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postComposeInsert)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), "Dear test,") {
+		checkSession(t)
+		t.Errorf("Expected status 200 with the template filled in; got %d", rw.Code)
+	}
+}
+
+func TestGetTemplates(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/templates/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getTemplates)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+}
+
+func TestPostContactsImport(t *testing.T) {
+	// a letter from the address that will be imported
+	mailId, err := newMail(Mail{UserId: 1, Folder: "archive", Read: true, FromHead: "Pen Friend <penfriend@localhost>",
+		FromName: "Pen Friend", FromAddr: "penfriend@localhost", MessageId: "import-letter", Subject: "hello"}, nil, 0)
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from mail where from_addr = 'penfriend@localhost'")
+	defer db.Exec("delete from mail_fts where rowid = ?", mailId)
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	file, err := form.CreateFormFile("vcard", "contacts.vcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Pen Friend\r\nNICKNAME:Penny\r\nEMAIL;TYPE=INTERNET:PenFriend@localhost\r\n" +
+		"NOTE:met at the\r\n  post office\r\nEND:VCARD\r\nBEGIN:VCARD\r\nFN:No Address\r\nEND:VCARD\r\n"))
+	form.Close()
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/mail/contacts/import/", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postContactsImport)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		t.Fatalf("Expected status 303; got %d", rw.Code)
+	}
+	contact, err := loadContactByAddr(1, "penfriend@localhost")
+	if err != nil || contact.Nickname != "Penny" || contact.Notes != "met at the post office" {
+		t.Fatalf("Expected the imported contact; got %v", err)
+	}
+
+	// the conversation shows the nickname
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/mail/conv/"+strconv.Itoa(mailId)+"/read/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+	req.SetPathValue("mailId", strconv.Itoa(mailId))
+
+	makeAuthedHandler(getConv)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), "Conversation with Penny") {
+		t.Errorf("Expected status 200 with the contact's nickname; got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/mail/contacts/autocomplete/?q=pen", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getAutocomplete)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), `{"addr":"penfriend@localhost","name":"Penny"}`) {
+		t.Errorf("Expected status 200 with the contact; got %d, %s", rw.Code, rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/mail/contacts/export/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getContactsExport)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), "EMAIL;TYPE=INTERNET:penfriend@localhost") {
+		t.Errorf("Expected status 200 with the contact as a vCard; got %d", rw.Code)
+	}
+
+	err = deleteContact(1, contact.ContactId)
+	if err != nil {
+		t.Errorf("Database error: %s", err.Error())
+	}
+}
+
+func TestGetContacts(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/contacts/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getContacts)(rw, req)
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Errorf("Expected status 200; got %d", rw.Code)
+	}
+}
+
+func TestPostListing(t *testing.T) {
+	rw := httptest.NewRecorder()
+	body := strings.NewReader("bio=I+like+long+letters&interests=gardening&language=English")
+	req := httptest.NewRequest("POST", "/mail/directory/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postListing)(rw, req)
+	if rw.Code != 303 {
+		checkSession(t)
+		t.Fatalf("Expected status 303; got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/mail/directory/?q=garden&language=english", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getDirectory)(rw, req)
+	if rw.Code != 200 || !strings.Contains(rw.Body.String(), "You are listed") {
+		t.Errorf("Expected status 200 with the user's listing; got %d", rw.Code)
+	}
+
+	// another listed user, found only by matching filters
+	userId, err := newUser(User{Username: "penpal", DisplayName: "Pen Pal", Password: []byte("x")})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from users where username = 'penpal'")
+	err = updateListing(Listing{UserId: *userId, Bio: "Writing from the coast", Interests: "Gardening, birds",
+		Language: "English"})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer deleteListing(*userId)
+
+	for query, listed := range map[string]bool{"q=garden&language=english": true, "q=BIRDS": true,
+		"q=garden+knitting": false, "language=French": false, "": true} {
+		rw = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/mail/directory/?"+query, nil)
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+		makeAuthedHandler(getDirectory)(rw, req)
+		if rw.Code != 200 || strings.Contains(rw.Body.String(), "penpal@localhost") != listed {
+			t.Errorf("Expected status 200 with the other listing shown %v for %q; got %d", listed, query, rw.Code)
+		}
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/mail/directory/remove/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postListingRemove)(rw, req)
+	_, err = loadListing(1)
+	if rw.Code != 303 || err != ErrNotFound {
+		t.Errorf("Expected status 303 and the listing removed; got %d, %v", rw.Code, err)
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	// two letters delivered last year, on days in a row
+	year := time.Now().Year() - 1
+	for day := 2; day <= 3; day++ {
+		date := time.Date(year, time.January, day, 0, 0, 0, 0, time.Local).Unix()
+		_, err := db.Exec(`insert into mail values (null, 1, 'archive', 1, ?, ?, 'stats@localhost', 'Stats', 'stats@localhost',
+			'', '', '', 'stats', '', 0, 0, 0)`, date-3600, date)
+		if err != nil {
+			t.Fatalf("Database error: %s", err.Error())
+		}
+	}
+	defer db.Exec("delete from mail where from_addr = 'stats@localhost'")
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/mail/stats/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getStats)(rw, req)
+	page := rw.Body.String()
+	if rw.Code != 200 {
+		checkSession(t)
+		t.Fatalf("Expected status 200; got %d", rw.Code)
+	}
+	if !strings.Contains(page, strconv.Itoa(year)+" in letters") || !strings.Contains(page, "You received 2 letters") ||
+		!strings.Contains(page, "busiest month was January") {
+		t.Error("Expected a summary of last year's letters")
+	}
+
+	// a letter sent to another user still counts after the recipient deletes it
+	userId, err := newUser(User{Username: "statspal", DisplayName: "Stats Pal", Password: []byte("x")})
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+	defer db.Exec("delete from users where username = 'statspal'")
+	defer db.Exec("delete from sent_letters where recipient_addr = 'statspal@localhost'")
+
+	rw = httptest.NewRecorder()
+	body := strings.NewReader("to=statspal%40localhost&subject=stats&content=counted")
+	req = httptest.NewRequest("POST", "/mail/compose/send/", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(postComposeSend)(rw, req)
+	if rw.Code != 303 {
+		t.Fatalf("Expected status 303; got %d", rw.Code)
+	}
+	_, err = db.Exec("delete from mail where user_id = ?", *userId)
+	if err != nil {
+		t.Fatalf("Database error: %s", err.Error())
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/mail/stats/", nil)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: "1"})
+
+	makeAuthedHandler(getStats)(rw, req)
+	if !strings.Contains(rw.Body.String(), "statspal@localhost") {
+		t.Error("Expected the recipient of a sent letter among the correspondents")
+	}
+}
+
 func TestLogout(t *testing.T) {
 	rw := httptest.NewRecorder()
 	req := httptest.NewRequest("GET", "/logout/", nil)
@@ -6,7 +6,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+	// time zones for users' preferences, on servers without a zone database
+	_ "time/tzdata"
 )
 
 // notice that message couldn't be sent
@@ -16,6 +19,44 @@ const messageNotSent = "**Sorry, the below message could not be sent:**\n\n"
 // page length for mailboxes
 const mailPerPage = 12
 
+// characters of a letter loaded for its preview in a mailbox. Previews are cut shorter after markup is removed.
+const previewLength = 400
+
+// senders suggested as contacts on the address book page
+const suggestedContacts = 10
+
+// correspondents shown on the statistics page, and in a year's summary
+const topCorrespondents = 10
+const yearTopCorrespondents = 3
+
+// reminders shown at a time in the inbox
+const reminderLimit = 10
+
+// most days ahead that a reminder can be set for
+const maxReminderDays = 365
+
+// addresses suggested at a time for the "To:" field
+const autocompleteMatches = 8
+
+// shortest password, and longest display name, that an account can have
+const minPasswordLength = 5
+const maxDisplayName = 40
+
+// time that a password reset link works for
+const resetExpiration = time.Hour
+
+// time that a link to confirm a new recovery address works for
+const recoveryExpiration = 24 * time.Hour
+
+// time after sending a password reset link before another can be sent to the same user
+const resetInterval = 5 * time.Minute
+
+// earlier revisions kept for each draft
+const draftRevisionLimit = 20
+
+// shortest time between revisions recorded by autosave. Saving a draft by hand always records one.
+const autosaveRevisionInterval = 10 * time.Minute
+
 // time of delivery, as a time.Duration since midnight local time
 var timeOfDelivery, _ = time.ParseDuration("14h35m")
 
@@ -25,21 +66,105 @@ var temps *template.Template
 // host name for email addresses
 var host string
 
+// largest total size of attachments on one letter, in bytes
+var letterAttachmentLimit int64
+
+// largest total size of attachments a user can store, in bytes. Uploads beyond this are refused.
+var userAttachmentQuota int64
+
+// days that mail stays in the trash before it is permanently deleted
+var trashDays int
+
+// whether mail superseded by a later mail from the same sender on the same day is dropped,
+// instead of being delivered to the conversation
+var dropSuperseded bool
+
+// sends mail outside Slow Mail, or nil if it can't be sent and password resets are off
+var transport MailTransport
+
+// URL that the server is reached at, for links in mail sent outside Slow Mail
+var baseURL string
+
 func startServer() error {
 	http.HandleFunc("GET /signup/{$}", getSignup)
 	http.HandleFunc("POST /signup/{$}", postSignup)
 	http.HandleFunc("GET /login/{$}", getLogin)
 	http.HandleFunc("POST /login/{$}", postLogin)
 	http.HandleFunc("GET /logout/{$}", logout)
+	http.HandleFunc("GET /reset/{$}", getResetRequest)
+	http.HandleFunc("POST /reset/{$}", postResetRequest)
+	http.HandleFunc("GET /reset/{token}/{$}", getResetPassword)
+	http.HandleFunc("POST /reset/{token}/{$}", postResetPassword)
+	http.HandleFunc("GET /account/{$}", makeAuthedHandler(getAccount))
+	http.HandleFunc("POST /account/{$}", makeAuthedHandler(postAccount))
+	http.HandleFunc("GET /account/recovery/{token}/{$}", getRecoveryConfirm)
 	http.HandleFunc("GET /mail/folder/inbox/{$}", makeAuthedHandler(getMailbox))
 	http.HandleFunc("GET /mail/folder/archive/{$}", makeAuthedHandler(getMailbox))
 	http.HandleFunc("GET /mail/folder/drafts/{$}", makeAuthedHandler(getDrafts))
+	http.HandleFunc("GET /mail/day/{date}/{$}", makeAuthedHandler(getDay))
+	http.HandleFunc("GET /mail/folder/requests/{$}", makeAuthedHandler(getRequests))
+	http.HandleFunc("POST /mail/folder/requests/settings/{$}", makeAuthedHandler(postContactsOnly))
+	http.HandleFunc("POST /mail/requests/{mailId}/accept/{$}", makeAuthedHandler(postRequest))
+	http.HandleFunc("POST /mail/requests/{mailId}/decline/{$}", makeAuthedHandler(postRequest))
+	http.HandleFunc("GET /mail/folder/trash/{$}", makeAuthedHandler(getTrash))
+	http.HandleFunc("POST /mail/folder/trash/empty/{$}", makeAuthedHandler(postTrashEmpty))
+	http.HandleFunc("GET /mail/search/{$}", makeAuthedHandler(getSearch))
+	http.HandleFunc("GET /mail/folder/label/{labelId}/{$}", makeAuthedHandler(getLabelFolder))
+	http.HandleFunc("GET /mail/blocks/{$}", makeAuthedHandler(getBlocks))
+	http.HandleFunc("POST /mail/blocks/{$}", makeAuthedHandler(postBlock))
+	http.HandleFunc("POST /mail/blocks/unblock/{$}", makeAuthedHandler(postUnblock))
+	http.HandleFunc("GET /mail/directory/{$}", makeAuthedHandler(getDirectory))
+	http.HandleFunc("POST /mail/directory/{$}", makeAuthedHandler(postListing))
+	http.HandleFunc("POST /mail/directory/remove/{$}", makeAuthedHandler(postListingRemove))
+	http.HandleFunc("GET /mail/stats/{$}", makeAuthedHandler(getStats))
+	http.HandleFunc("GET /mail/contacts/{$}", makeAuthedHandler(getContacts))
+	http.HandleFunc("POST /mail/contacts/{$}", makeAuthedHandler(postContact))
+	http.HandleFunc("POST /mail/contacts/{contactId}/edit/{$}", makeAuthedHandler(postContactEdit))
+	http.HandleFunc("POST /mail/contacts/{contactId}/delete/{$}", makeAuthedHandler(postContactDelete))
+	http.HandleFunc("POST /mail/contacts/import/{$}", makeAuthedHandler(postContactsImport))
+	http.HandleFunc("GET /mail/contacts/export/{$}", makeAuthedHandler(getContactsExport))
+	http.HandleFunc("GET /mail/contacts/autocomplete/{$}", makeAuthedHandler(getAutocomplete))
+	http.HandleFunc("GET /mail/templates/{$}", makeAuthedHandler(getTemplates))
+	http.HandleFunc("POST /mail/templates/{$}", makeAuthedHandler(postTemplate))
+	http.HandleFunc("POST /mail/templates/{templateId}/edit/{$}", makeAuthedHandler(postTemplateEdit))
+	http.HandleFunc("POST /mail/templates/{templateId}/delete/{$}", makeAuthedHandler(postTemplateDelete))
+	http.HandleFunc("GET /mail/labels/{$}", makeAuthedHandler(getLabels))
+	http.HandleFunc("POST /mail/labels/{$}", makeAuthedHandler(postLabel))
+	http.HandleFunc("POST /mail/labels/{labelId}/rename/{$}", makeAuthedHandler(postLabelRename))
+	http.HandleFunc("POST /mail/labels/{labelId}/delete/{$}", makeAuthedHandler(postLabelDelete))
 	http.HandleFunc("GET /mail/compose/{$}", makeAuthedHandler(getCompose))
+	http.HandleFunc("GET /mail/draft/{draftId}/edit/{$}", makeAuthedHandler(getDraftEdit))
+	http.HandleFunc("POST /mail/draft/{draftId}/edit/{$}", makeAuthedHandler(postDraftEdit))
+	http.HandleFunc("POST /mail/draft/{draftId}/send/{$}", makeAuthedHandler(postDraftSend))
+	http.HandleFunc("POST /mail/draft/{draftId}/delete/{$}", makeAuthedHandler(postDraftDelete))
+	http.HandleFunc("POST /mail/draft/{draftId}/autosave/{$}", makeAuthedHandler(postAutosave))
+	http.HandleFunc("POST /mail/compose/autosave/{$}", makeAuthedHandler(postAutosave))
+	http.HandleFunc("GET /mail/draft/{draftId}/revisions/{$}", makeAuthedHandler(getRevisions))
+	http.HandleFunc("POST /mail/draft/{draftId}/revisions/{revisionId}/restore/{$}", makeAuthedHandler(postRevisionRestore))
 	http.HandleFunc("POST /mail/compose/send/{$}", makeAuthedHandler(postComposeSend))
 	http.HandleFunc("POST /mail/compose/{$}", makeAuthedHandler(postComposeSave))
+	http.HandleFunc("POST /mail/compose/insert/{$}", makeAuthedHandler(postComposeInsert))
 	http.HandleFunc("GET /mail/conv/{mailId}/read/{$}", makeAuthedHandler(getConv))
+	http.HandleFunc("GET /mail/conv/{mailId}/export/{format}/{$}", makeAuthedHandler(getBook))
+	http.HandleFunc("GET /mail/attachment/{attachmentId}/{$}", makeAuthedHandler(getAttachment))
 	http.HandleFunc("POST /mail/conv/{mailId}/send/{$}", makeAuthedHandler(postComposeSend))
 	http.HandleFunc("POST /mail/conv/{mailId}/save/{$}", makeAuthedHandler(postComposeSave))
+	http.HandleFunc("POST /mail/conv/{mailId}/archive/{$}", makeAuthedHandler(postConvFolder))
+	http.HandleFunc("POST /mail/conv/{mailId}/unarchive/{$}", makeAuthedHandler(postConvFolder))
+	http.HandleFunc("POST /mail/conv/{mailId}/unread/{$}", makeAuthedHandler(postConvUnread))
+	http.HandleFunc("POST /mail/conv/{mailId}/labels/{$}", makeAuthedHandler(postConvLabels))
+	http.HandleFunc("POST /mail/conv/{mailId}/block/{$}", makeAuthedHandler(postConvBlock))
+	http.HandleFunc("POST /mail/conv/{mailId}/remind/{$}", makeAuthedHandler(postReminder))
+	http.HandleFunc("POST /mail/conv/{mailId}/remind/dismiss/{$}", makeAuthedHandler(postReminderDismiss))
+	http.HandleFunc("POST /mail/conv/{mailId}/snooze/{$}", makeAuthedHandler(postSnooze))
+	http.HandleFunc("POST /mail/conv/{mailId}/delete/{$}", makeAuthedHandler(postConvTrash))
+	http.HandleFunc("POST /mail/conv/{mailId}/restore/{$}", makeAuthedHandler(postConvTrash))
+	http.HandleFunc("GET /mail/piece/{mailId}/forward/{$}", makeAuthedHandler(getForward))
+	http.HandleFunc("POST /mail/piece/{mailId}/snooze/{$}", makeAuthedHandler(postSnooze))
+	http.HandleFunc("POST /mail/piece/{mailId}/delete/{$}", makeAuthedHandler(postPieceTrash))
+	http.HandleFunc("POST /mail/piece/{mailId}/restore/{$}", makeAuthedHandler(postPieceTrash))
+	http.HandleFunc("POST /mail/folder/inbox/settings/{$}", makeAuthedHandler(postNudgeDays))
+	http.HandleFunc("POST /mail/folder/inbox/read/{$}", makeAuthedHandler(postInboxRead))
 	http.Handle("GET /{$}", http.RedirectHandler("/mail/folder/inbox", http.StatusSeeOther))
 
 	err := http.ListenAndServe(":80", nil)
@@ -50,13 +175,43 @@ func appInit() {
 	var dbPath string
 	flag.StringVar(&dbPath, "db", "", "Path to the database (required)")
 	flag.StringVar(&host, "host", "", "Host name for email addresses (required)")
+	flag.Int64Var(&letterAttachmentLimit, "attachment-limit", 10<<20, "Largest total size of attachments on one letter, in bytes")
+	flag.Int64Var(&userAttachmentQuota, "attachment-quota", 100<<20, "Largest total size of attachments a user can store, in bytes")
+	flag.IntVar(&trashDays, "trash-days", 30, "Days to keep mail in the trash before deleting it")
+	flag.BoolVar(&dropSuperseded, "drop-superseded", false,
+		"Drop mail superseded by a later mail from the same sender on the same day")
+	var transportSpec, mailFrom string
+	flag.StringVar(&transportSpec, "mail-transport", "",
+		`How to send password reset links: "file:DIR" or "smtp://[user:pass@]host:port". Resets are off without one.`)
+	flag.StringVar(&mailFrom, "mail-from", "", `Address that password reset links are sent from (default "no-reply@" and the host)`)
+	flag.StringVar(&baseURL, "base-url", "", `URL the server is reached at, for links in mail (default "http://" and the host)`)
 	flag.Parse()
 	if dbPath == "" || host == "" {
 		log.Println("Error: please provide all required flags.")
 		flag.Usage()
 		os.Exit(1)
 	}
+	if mailFrom == "" {
+		mailFrom = "no-reply@" + host
+	}
+	if baseURL == "" {
+		baseURL = "http://" + host
+	}
+	baseURL = strings.TrimRight(baseURL, "/")
 
+	var err error
+	transport, err = parseTransport(transportSpec, mailFrom)
+	if err != nil {
+		log.Println("Error: " + err.Error())
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	openResources(dbPath)
+}
+
+/* openResources: parses the templates and connects to the database */
+func openResources(dbPath string) {
 	var err error
 	temps, err = template.ParseGlob("templates/*.go.tmpl")
 	if err != nil {
@@ -71,9 +226,85 @@ func appInit() {
 	db.SetMaxOpenConns(1) // it is slow mail after all
 }
 
+/*
+	exportCommand
+
+The `export` subcommand: writes a user's conversation with a sender as a book, like the
+export route on the conversation page. For example:
+
+	slowmail export -db slowmail.db -user ann -from bob@example.com -format epub -o letters.epub
+*/
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := flags.String("db", "", "Path to the database (required)")
+	username := flags.String("user", "", "User whose conversation is exported (required)")
+	from := flags.String("from", "", "Address of the sender the conversation is with (required)")
+	format := flags.String("format", "epub", `Format of the book, "epub" or "html"`)
+	outPath := flags.String("o", "", "File to write the book to, instead of standard output")
+	flags.BoolVar(&dropSuperseded, "drop-superseded", false, "Leave out mail superseded by a later mail on the same day")
+	flags.Parse(args)
+	if *dbPath == "" || *username == "" || *from == "" || bookFormats[*format] == "" {
+		log.Println("Error: please provide all required flags, and a known format.")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	openResources(*dbPath)
+	defer db.Close()
+
+	user, err := loadUser(*username)
+	if err != nil {
+		log.Fatalln("Could not load user:", err)
+	}
+	sender, err := loadSender(user.UserId, *from)
+	if err != nil {
+		log.Fatalln("Could not find the conversation:", err)
+	}
+	book, err := loadBook(user.UserId, user.DisplayName, sender, currDate().Unix())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	out := os.Stdout
+	if *outPath != "" {
+		out, err = os.Create(*outPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer out.Close()
+	}
+	err = writeBook(out, *format, book)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+/*
+	purgeTrashJob
+
+Permanently deletes mail that has been in the trash for longer than trashDays. Checks
+every hour, forever, so it should run in its own goroutine.
+*/
+func purgeTrashJob() {
+	for {
+		before := time.Now().AddDate(0, 0, -trashDays)
+		err := purgeTrash(before.Unix())
+		if err != nil {
+			log.Println(err.Error())
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		exportCommand(os.Args[2:])
+		return
+	}
+
 	appInit()
 	defer db.Close()
+	go purgeTrashJob()
 	err := startServer()
 	if err != nil {
 		log.Panic(err)
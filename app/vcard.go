@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+/*
+Contacts are imported and exported as vCards (RFC 6350). Only the properties that a contact
+has are used: FN and NICKNAME for its name, EMAIL for its address and NOTE for its notes.
+*/
+
+/*
+	parseVCards
+
+Reads contacts from vCard data. Cards without an email address are skipped, and a card with
+several addresses gives the first. The FN property is used as the nickname if there is no
+NICKNAME.
+*/
+func parseVCards(reader io.Reader) ([]Contact, error) {
+	lines, err := unfoldVCardLines(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var contacts []Contact
+	var card Contact
+	var fullName string
+	for _, line := range lines {
+		nameParams, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		// the property name comes before any parameters, and may have a group prefix
+		name, _, _ := strings.Cut(nameParams, ";")
+		if _, after, grouped := strings.Cut(name, "."); grouped {
+			name = after
+		}
+
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			card = Contact{}
+			fullName = ""
+		case "END":
+			if card.Nickname == "" {
+				card.Nickname = fullName
+			}
+			if card.Addr != "" {
+				contacts = append(contacts, card)
+			}
+		case "EMAIL":
+			if card.Addr == "" {
+				card.Addr = strings.TrimPrefix(strings.TrimSpace(unescapeVCard(value)), "mailto:")
+			}
+		case "FN":
+			fullName = unescapeVCard(value)
+		case "NICKNAME":
+			// a list of nicknames, of which the first is used
+			first, _, _ := strings.Cut(value, ",")
+			card.Nickname = unescapeVCard(first)
+		case "NOTE":
+			card.Notes = unescapeVCard(value)
+		}
+	}
+	return contacts, nil
+}
+
+/* unfoldVCardLines: reads the lines of vCard data, joining lines that are folded onto the next line */
+func unfoldVCardLines(reader io.Reader) ([]string, error) {
+	var lines []string
+	// lines can be long, e.g. with embedded photos, so they aren't read with a bufio.Scanner
+	buffered := bufio.NewReader(reader)
+	for {
+		line, err := buffered.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+
+		if err == io.EOF {
+			return lines, nil
+		}
+	}
+}
+
+var vCardUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+var vCardEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`)
+
+func unescapeVCard(value string) string {
+	return vCardUnescaper.Replace(value)
+}
+
+/*
+	writeVCards
+
+Writes contacts as vCard 3.0 data. A contact without a nickname is named by its address,
+since every card needs an FN property.
+*/
+func writeVCards(writer io.Writer, contacts []Contact) error {
+	var out strings.Builder
+	for _, c := range contacts {
+		fullName := c.Nickname
+		if fullName == "" {
+			fullName = c.Addr
+		}
+
+		out.WriteString("BEGIN:VCARD\r\nVERSION:3.0\r\n")
+		out.WriteString("FN:" + vCardEscaper.Replace(fullName) + "\r\n")
+		if c.Nickname != "" {
+			out.WriteString("NICKNAME:" + vCardEscaper.Replace(c.Nickname) + "\r\n")
+		}
+		out.WriteString("EMAIL;TYPE=INTERNET:" + vCardEscaper.Replace(c.Addr) + "\r\n")
+		if c.Notes != "" {
+			out.WriteString("NOTE:" + vCardEscaper.Replace(strings.ReplaceAll(c.Notes, "\r\n", "\n")) + "\r\n")
+		}
+		out.WriteString("END:VCARD\r\n")
+	}
+
+	_, err := io.WriteString(writer, out.String())
+	return err
+}
@@ -3,3 +3,8 @@ module github.com/ngriffiths21/slowmail
 go 1.22
 
 require github.com/mattn/go-sqlite3 v1.14.23
+
+require (
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0 // indirect
+)